@@ -0,0 +1,103 @@
+package main
+
+// bandwidthStepKbps rounds computed limits down to a coarse step so small
+// fluctuations in reported session bandwidth don't re-apply the limit on
+// every poll.
+const bandwidthStepKbps = 64
+
+// streamingLimitKbps returns the upload limit to use while remote streams are
+// active. Only remote sessions are considered here; local ones are covered
+// by the local_protection limits.
+//
+// In fixed mode this is the most restrictive of the per-decision limits
+// (direct play, direct stream, transcode) of the counted sessions, falling
+// back to the active profile's streaming upload limit. In bandwidth mode it is
+// whatever is left of the uplink after the counted sessions (scaled by their
+// weight) and the safety margin, never dropping below MinStreamingUploadKbps.
+//
+// If relax_throttled_transcodes is set and every counted session is a
+// transcode that Plex has throttled because it is far enough ahead,
+// RelaxedUploadKbps is used instead. A limit assigned by a session rule caps
+// the result in every case.
+func streamingLimitKbps(cfg *Config, profile Profile, verdicts []SessionVerdict) int {
+	var limit int
+	switch {
+	case cfg.RelaxThrottledTranscodes && allTranscodesThrottled(verdicts):
+		limit = cfg.RelaxedUploadKbps
+	case cfg.ThrottleMode == ThrottleModeBandwidth:
+		limit = bandwidthLimitKbps(cfg, verdicts)
+	default:
+		limit = decisionLimitKbps(cfg, profile, verdicts)
+	}
+
+	return minLimit(limit, sessionLimitKbps(verdicts))
+}
+
+func decisionLimitKbps(cfg *Config, profile Profile, verdicts []SessionVerdict) int {
+	limit := 0
+	for _, v := range verdicts {
+		if !v.Counted || !v.Remote {
+			continue
+		}
+		sessionLimit := cfg.decisionUploadKbps(v.Session.Decision)
+		if sessionLimit == 0 {
+			sessionLimit = profile.Streaming.UploadKbps
+		}
+		limit = minLimit(limit, sessionLimit)
+	}
+	if limit == 0 {
+		return profile.Streaming.UploadKbps
+	}
+	return limit
+}
+
+func bandwidthLimitKbps(cfg *Config, verdicts []SessionVerdict) int {
+	used := 0.0
+	for _, v := range verdicts {
+		if !v.Counted || !v.Remote {
+			continue
+		}
+		if v.Session.BandwidthKbps > 0 {
+			used += float64(v.Session.BandwidthKbps) * v.Weight
+		} else {
+			used += float64(cfg.FallbackStreamKbps) * v.Weight
+		}
+	}
+
+	limit := cfg.UplinkCapacityKbps - int(used) - cfg.BandwidthMarginKbps
+	limit -= limit % bandwidthStepKbps
+	if limit < cfg.MinStreamingUploadKbps {
+		limit = cfg.MinStreamingUploadKbps
+	}
+	return limit
+}
+
+func allTranscodesThrottled(verdicts []SessionVerdict) bool {
+	counted := 0
+	for _, v := range verdicts {
+		if !v.Counted || !v.Remote {
+			continue
+		}
+		if v.Session.Decision != DecisionTranscode || !v.Session.Throttled {
+			return false
+		}
+		counted++
+	}
+	return counted > 0
+}
+
+// minLimits combines two sets of limits, keeping the lower of each.
+func minLimits(a, b Limits) Limits {
+	return Limits{
+		UploadKbps:   minLimit(a.UploadKbps, b.UploadKbps),
+		DownloadKbps: minLimit(a.DownloadKbps, b.DownloadKbps),
+	}
+}
+
+// minLimit returns the lower of two limits, where 0 means unlimited.
+func minLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
@@ -3,27 +3,241 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ThrottleModeFixed     = "fixed"
+	ThrottleModeBandwidth = "bandwidth"
+
+	ThrottleStrategyGlobalLimit = "global_limit"
+	ThrottleStrategyAltSpeed    = "alt_speed"
 )
 
 type Config struct {
-	PlexURL                  string `json:"plex_url"`
-	PlexToken                string `json:"plex_token"`
-	QBittorrentURL           string `json:"qbittorrent_url"`
-	QBittorrentUsername      string `json:"qbittorrent_username"`
-	QBittorrentPassword      string `json:"qbittorrent_password"`
-	IdleUploadKbps           int    `json:"idle_upload_kbps"`
-	StreamingUploadKbps      int    `json:"streaming_upload_kbps"`
-	PollIntervalSec          int    `json:"poll_interval_sec"`
-	StreamingThreshold       int    `json:"streaming_threshold"`
-	IdleThreshold            int    `json:"idle_threshold"`
-	TelegramBotToken         string `json:"telegram_bot_token"`
-	TelegramChatID           string `json:"telegram_chat_id"`
-	HealthPort               int    `json:"health_port"`
-	CooldownMaxTransitions       int    `json:"cooldown_max_transitions"`
-	CooldownWindowMinutes        int    `json:"cooldown_window_minutes"`
-	CooldownStatePath            string `json:"cooldown_state_path"`
-	ManualThrottleDefaultMinutes int    `json:"manual_throttle_default_minutes"`
+	PlexURL                      string                 `json:"plex_url"`
+	PlexToken                    string                 `json:"plex_token"`
+	PlexTokenFile                string                 `json:"plex_token_file"`
+	MediaServers                 []MediaServerConfig    `json:"media_servers"`
+	QBittorrentURL               string                 `json:"qbittorrent_url"`
+	QBittorrentUsername          string                 `json:"qbittorrent_username"`
+	QBittorrentPassword          string                 `json:"qbittorrent_password"`
+	IdleUploadKbps               int                    `json:"idle_upload_kbps"`
+	StreamingUploadKbps          int                    `json:"streaming_upload_kbps"`
+	IdleDownloadKbps             int                    `json:"idle_download_kbps"`
+	StreamingDownloadKbps        int                    `json:"streaming_download_kbps"`
+	ThrottleMode                 string                 `json:"throttle_mode"`
+	ThrottleStrategy             string                 `json:"throttle_strategy"`
+	UplinkCapacityKbps           int                    `json:"uplink_capacity_kbps"`
+	BandwidthMarginKbps          int                    `json:"bandwidth_margin_kbps"`
+	MinStreamingUploadKbps       int                    `json:"min_streaming_upload_kbps"`
+	FallbackStreamKbps           int                    `json:"fallback_stream_kbps"`
+	DirectPlayUploadKbps         int                    `json:"direct_play_upload_kbps"`
+	DirectStreamUploadKbps       int                    `json:"direct_stream_upload_kbps"`
+	TranscodeUploadKbps          int                    `json:"transcode_upload_kbps"`
+	RelaxThrottledTranscodes     bool                   `json:"relax_throttled_transcodes"`
+	RelaxedUploadKbps            int                    `json:"relaxed_upload_kbps"`
+	LocalProtection              bool                   `json:"local_protection"`
+	LocalStreamingUploadKbps     int                    `json:"local_streaming_upload_kbps"`
+	LocalStreamingDownloadKbps   int                    `json:"local_streaming_download_kbps"`
+	Timezone                     string                 `json:"timezone"`
+	Schedule                     []ScheduleProfile      `json:"schedule"`
+	PollIntervalSec              int                    `json:"poll_interval_sec"`
+	StreamingThreshold           int                    `json:"streaming_threshold"`
+	IdleThreshold                int                    `json:"idle_threshold"`
+	TelegramBotToken             string                 `json:"telegram_bot_token"`
+	TelegramChatID               string                 `json:"telegram_chat_id"`
+	TelegramAPIURL               string                 `json:"telegram_api_url"`
+	TelegramWebhookURL           string                 `json:"telegram_webhook_url"`
+	TelegramChats                []TelegramChatConfig   `json:"telegram_chats"`
+	TelegramUsers                []TelegramUserConfig   `json:"telegram_users"`
+	TelegramTemplate             string                 `json:"telegram_template"`
+	Notifiers                    []NotifierConfig       `json:"notifiers"`
+	NotificationPosters          bool                   `json:"notification_posters"`
+	HealthPort                   int                    `json:"health_port"`
+	WebhookToken                 string                 `json:"webhook_token"`
+	WebhookAllowedCIDRs          []string               `json:"webhook_allowed_cidrs"`
+	CooldownMaxTransitions       int                    `json:"cooldown_max_transitions"`
+	CooldownWindowMinutes        int                    `json:"cooldown_window_minutes"`
+	CooldownStatePath            string                 `json:"cooldown_state_path"`
+	RuntimeStatePath             string                 `json:"runtime_state_path"`
+	ManualThrottleDefaultMinutes int                    `json:"manual_throttle_default_minutes"`
+	TorrentPolicies              []TorrentPolicy        `json:"torrent_policies"`
+	SessionRules                 []SessionRule          `json:"session_rules"`
+	PauseGraceSec                int                    `json:"pause_grace_sec"`
+	MaxPauseSec                  int                    `json:"max_pause_sec"`
+	DownloadClients              []DownloadClientConfig `json:"download_clients"`
+}
+
+const (
+	SourceTypePlex     = "plex"
+	SourceTypeJellyfin = "jellyfin"
+	SourceTypeEmby     = "emby"
+	SourceTypeTautulli = "tautulli"
+)
+
+// MediaServerConfig describes one media server to watch. Type defaults to
+// plex; Token is a Plex token or a Jellyfin/Emby/Tautulli API key, and
+// defaults to plex_token for plex entries. A
+// tautulli entry reads its Plex server's sessions through Tautulli, so it
+// replaces rather than accompanies a plex entry for the same server. Name
+// defaults to the type and is used in logs and /health.
+type MediaServerConfig struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+const (
+	ClientTypeQBittorrent  = "qbittorrent"
+	ClientTypeTransmission = "transmission"
+	ClientTypeDeluge       = "deluge"
+	ClientTypeSABnzbd      = "sabnzbd"
+)
+
+// DownloadClientConfig describes one download client to throttle. Name
+// defaults to the type and is used in logs and /health.
+type DownloadClientConfig struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	APIKey   string `json:"api_key"`
+}
+
+const (
+	PolicyActionKeep  = "keep"
+	PolicyActionLimit = "limit"
+	PolicyActionPause = "pause"
+)
+
+// TorrentPolicy selects torrents by qBittorrent category and/or tag and says
+// what to do with them while streaming. The first matching policy wins.
+type TorrentPolicy struct {
+	Category   string `json:"category"`
+	Tag        string `json:"tag"`
+	Action     string `json:"action"`
+	UploadKbps int    `json:"upload_kbps"`
+}
+
+// Telegram roles, from least to most privileged. Each role can also use the
+// commands of the roles before it: viewers can check the status, operators
+// can set a manual throttle, and admins can change the base limits with /set.
+const (
+	TelegramRoleViewer   = "viewer"
+	TelegramRoleOperator = "operator"
+	TelegramRoleAdmin    = "admin"
+)
+
+// Kinds of notification a Telegram chat or notifier can subscribe to.
+const (
+	NotifyStreaming = "streaming"
+	NotifySchedule  = "schedule"
+	NotifyManual    = "manual"
+	NotifyDrift     = "drift"
+)
+
+var notifyKinds = []string{NotifyStreaming, NotifySchedule, NotifyManual, NotifyDrift}
+
+const (
+	NotifierTypeDiscord = "discord"
+	NotifierTypeSlack   = "slack"
+	NotifierTypeNtfy    = "ntfy"
+	NotifierTypeGotify  = "gotify"
+	NotifierTypeApprise = "apprise"
+	NotifierTypeJSON    = "json"
+)
+
+// NotifierConfig describes one notification channel besides Telegram. URL
+// is the Discord/Slack webhook URL, the ntfy topic URL, the Gotify server,
+// the Apprise API notify URL or the JSON endpoint. Token is the Gotify app
+// token or an ntfy access token. Events limits the kinds of notification
+// sent, all by default. Template overrides the message text, rendered with
+// text/template from a Notification. Name defaults to the type and is used
+// in logs.
+type NotifierConfig struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	URL      string   `json:"url"`
+	Token    string   `json:"token"`
+	Events   []string `json:"events"`
+	Template string   `json:"template"`
+}
+
+// TelegramUserConfig authorises a Telegram user, identified by numeric user
+// ID since usernames are optional and can change. Role defaults to viewer.
+type TelegramUserConfig struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// TelegramChatConfig is a chat that receives notifications. Notify lists
+// the kinds it is subscribed to; leaving it out subscribes to all of them.
+type TelegramChatConfig struct {
+	ID     TelegramChatID `json:"id"`
+	Notify []string       `json:"notify"`
+}
+
+// TelegramChatID is a chat's numeric ID or, for a public channel,
+// "@channelusername". The Bot API accepts either as chat_id, and the config
+// may give a numeric ID as a number or a string.
+type TelegramChatID string
+
+func (id *TelegramChatID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = TelegramChatID(s)
+		return nil
+	}
+	var n int64
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("chat id must be a number or an @channelusername")
+	}
+	*id = numericChatID(n)
+	return nil
+}
+
+func numericChatID(n int64) TelegramChatID {
+	return TelegramChatID(strconv.FormatInt(n, 10))
+}
+
+func (id TelegramChatID) valid() bool {
+	if strings.HasPrefix(string(id), "@") {
+		return len(id) > 1
+	}
+	_, err := strconv.ParseInt(string(id), 10, 64)
+	return err == nil
+}
+
+const (
+	SessionActionIgnore = "ignore"
+	SessionActionWeight = "weight"
+	SessionActionLimit  = "limit"
+)
+
+// SessionRule matches Plex sessions by user, player product, player name
+// and/or address (an IP or CIDR) and changes how they count: ignore drops
+// them, weight scales their contribution to the stream count and bandwidth,
+// and limit caps the streaming upload limit while they are active. The
+// first matching rule wins.
+type SessionRule struct {
+	Name       string  `json:"name"`
+	User       string  `json:"user"`
+	Product    string  `json:"product"`
+	Player     string  `json:"player"`
+	Address    string  `json:"address"`
+	Action     string  `json:"action"`
+	Weight     float64 `json:"weight"`
+	UploadKbps int     `json:"upload_kbps"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -37,6 +251,13 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("parsing config JSON: %w", err)
 	}
 
+	if cfg.PlexTokenFile != "" {
+		token, err := os.ReadFile(cfg.PlexTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading plex_token_file: %w", err)
+		}
+		cfg.PlexToken = strings.TrimSpace(string(token))
+	}
 	if env := os.Getenv("PLEX_TOKEN"); env != "" {
 		cfg.PlexToken = env
 	}
@@ -49,6 +270,9 @@ func LoadConfig(path string) (*Config, error) {
 	if env := os.Getenv("TELEGRAM_CHAT_ID"); env != "" {
 		cfg.TelegramChatID = env
 	}
+	if env := os.Getenv("WEBHOOK_TOKEN"); env != "" {
+		cfg.WebhookToken = env
+	}
 
 	if err := cfg.validate(); err != nil {
 		return nil, err
@@ -60,19 +284,237 @@ func LoadConfig(path string) (*Config, error) {
 }
 
 func (c *Config) validate() error {
-	if c.PlexURL == "" {
-		return fmt.Errorf("plex_url is required")
+	if c.PlexURL == "" && len(c.MediaServers) == 0 {
+		return fmt.Errorf("plex_url or media_servers is required")
+	}
+	if c.PlexURL != "" && c.PlexToken == "" {
+		return fmt.Errorf("plex_token is required (run 'plex-helper login', or set it in config or the PLEX_TOKEN env var)")
+	}
+	for i, ms := range c.MediaServers {
+		if ms.URL == "" {
+			return fmt.Errorf("media_servers[%d]: url is required", i)
+		}
+		isPlex := ms.Type == "" || ms.Type == SourceTypePlex
+		if ms.Token == "" && !(isPlex && c.PlexToken != "") {
+			return fmt.Errorf("media_servers[%d]: token is required", i)
+		}
+		switch ms.Type {
+		case "", SourceTypePlex, SourceTypeJellyfin, SourceTypeEmby, SourceTypeTautulli:
+		default:
+			return fmt.Errorf("media_servers[%d]: unknown type %q", i, ms.Type)
+		}
+	}
+	if c.QBittorrentURL == "" && len(c.DownloadClients) == 0 {
+		return fmt.Errorf("qbittorrent_url or download_clients is required")
 	}
-	if c.PlexToken == "" {
-		return fmt.Errorf("plex_token is required (set in config or PLEX_TOKEN env var)")
+	for i, dc := range c.DownloadClients {
+		if dc.URL == "" {
+			return fmt.Errorf("download_clients[%d]: url is required", i)
+		}
+		switch dc.Type {
+		case ClientTypeQBittorrent, ClientTypeTransmission, ClientTypeDeluge:
+		case ClientTypeSABnzbd:
+			if dc.APIKey == "" {
+				return fmt.Errorf("download_clients[%d]: api_key is required for %s", i, ClientTypeSABnzbd)
+			}
+		default:
+			return fmt.Errorf("download_clients[%d]: unknown type %q", i, dc.Type)
+		}
 	}
-	if c.QBittorrentURL == "" {
-		return fmt.Errorf("qbittorrent_url is required")
+	switch c.ThrottleStrategy {
+	case "", ThrottleStrategyGlobalLimit:
+	case ThrottleStrategyAltSpeed:
+		if c.ThrottleMode == ThrottleModeBandwidth {
+			return fmt.Errorf("throttle_mode %q cannot be combined with throttle_strategy %q", ThrottleModeBandwidth, ThrottleStrategyAltSpeed)
+		}
+	default:
+		return fmt.Errorf("unknown throttle_strategy %q (expected %q or %q)", c.ThrottleStrategy, ThrottleStrategyGlobalLimit, ThrottleStrategyAltSpeed)
+	}
+	for i, p := range c.TorrentPolicies {
+		if p.Category == "" && p.Tag == "" {
+			return fmt.Errorf("torrent_policies[%d]: category or tag is required", i)
+		}
+		switch p.Action {
+		case PolicyActionKeep, PolicyActionPause:
+		case PolicyActionLimit:
+			if p.UploadKbps <= 0 {
+				return fmt.Errorf("torrent_policies[%d]: upload_kbps must be positive for action %q", i, PolicyActionLimit)
+			}
+		default:
+			return fmt.Errorf("torrent_policies[%d]: unknown action %q", i, p.Action)
+		}
+	}
+	if c.TelegramChatID != "" && !TelegramChatID(c.TelegramChatID).valid() {
+		return fmt.Errorf("telegram_chat_id must be a numeric chat ID or an @channelusername")
+	}
+	if c.TelegramWebhookURL != "" && c.HealthPort <= 0 {
+		return fmt.Errorf("health_port is required when telegram_webhook_url is set")
+	}
+	for i, chat := range c.TelegramChats {
+		if chat.ID == "" {
+			return fmt.Errorf("telegram_chats[%d]: id is required", i)
+		}
+		if !chat.ID.valid() {
+			return fmt.Errorf("telegram_chats[%d]: id must be a numeric chat ID or an @channelusername", i)
+		}
+		for _, kind := range chat.Notify {
+			if !slices.Contains(notifyKinds, kind) {
+				return fmt.Errorf("telegram_chats[%d]: unknown notification %q", i, kind)
+			}
+		}
+	}
+	if _, err := newMessageTemplate("telegram_template", c.TelegramTemplate, defaultTelegramTemplate); err != nil {
+		return err
+	}
+	for i, n := range c.Notifiers {
+		if n.URL == "" {
+			return fmt.Errorf("notifiers[%d]: url is required", i)
+		}
+		switch n.Type {
+		case NotifierTypeDiscord, NotifierTypeSlack, NotifierTypeNtfy, NotifierTypeApprise, NotifierTypeJSON:
+		case NotifierTypeGotify:
+			if n.Token == "" {
+				return fmt.Errorf("notifiers[%d]: token is required for %s", i, NotifierTypeGotify)
+			}
+		default:
+			return fmt.Errorf("notifiers[%d]: unknown type %q", i, n.Type)
+		}
+		for _, kind := range n.Events {
+			if !slices.Contains(notifyKinds, kind) {
+				return fmt.Errorf("notifiers[%d]: unknown event %q", i, kind)
+			}
+		}
+		if _, err := newMessageTemplate(fmt.Sprintf("notifiers[%d]", i), n.Template, ""); err != nil {
+			return err
+		}
+	}
+	for i, user := range c.TelegramUsers {
+		if user.ID == 0 {
+			return fmt.Errorf("telegram_users[%d]: id is required", i)
+		}
+		switch user.Role {
+		case "", TelegramRoleViewer, TelegramRoleOperator, TelegramRoleAdmin:
+		default:
+			return fmt.Errorf("telegram_users[%d]: unknown role %q", i, user.Role)
+		}
+	}
+	if c.LocalProtection && c.LocalStreamingUploadKbps <= 0 && c.LocalStreamingDownloadKbps <= 0 {
+		return fmt.Errorf("local_streaming_upload_kbps or local_streaming_download_kbps is required when local_protection is enabled")
+	}
+	if c.PauseGraceSec < 0 || c.MaxPauseSec < 0 {
+		return fmt.Errorf("pause_grace_sec and max_pause_sec must not be negative")
+	}
+	if _, err := NewSessionRules(c); err != nil {
+		return err
+	}
+	if _, err := c.webhookAllowedNets(); err != nil {
+		return err
+	}
+	if _, err := NewSchedule(c); err != nil {
+		return err
+	}
+	if c.DirectPlayUploadKbps < 0 || c.DirectStreamUploadKbps < 0 || c.TranscodeUploadKbps < 0 || c.RelaxedUploadKbps < 0 {
+		return fmt.Errorf("direct_play_upload_kbps, direct_stream_upload_kbps, transcode_upload_kbps and relaxed_upload_kbps must not be negative")
+	}
+	if c.RelaxThrottledTranscodes && c.RelaxedUploadKbps <= 0 {
+		// 0 would mean unlimited, lifting the throttle instead of relaxing it.
+		return fmt.Errorf("relaxed_upload_kbps must be positive when relax_throttled_transcodes is set")
+	}
+	switch c.ThrottleMode {
+	case "", ThrottleModeFixed:
+	case ThrottleModeBandwidth:
+		if c.UplinkCapacityKbps <= 0 {
+			return fmt.Errorf("uplink_capacity_kbps is required when throttle_mode is %q", ThrottleModeBandwidth)
+		}
+	default:
+		return fmt.Errorf("unknown throttle_mode %q (expected %q or %q)", c.ThrottleMode, ThrottleModeFixed, ThrottleModeBandwidth)
 	}
 	return nil
 }
 
 func (c *Config) applyDefaults() {
+	if c.QBittorrentURL != "" {
+		legacy := DownloadClientConfig{
+			Type:     ClientTypeQBittorrent,
+			URL:      c.QBittorrentURL,
+			Username: c.QBittorrentUsername,
+			Password: c.QBittorrentPassword,
+		}
+		c.DownloadClients = append([]DownloadClientConfig{legacy}, c.DownloadClients...)
+	}
+	if c.PlexURL != "" {
+		legacy := MediaServerConfig{Type: SourceTypePlex, URL: c.PlexURL, Token: c.PlexToken}
+		c.MediaServers = append([]MediaServerConfig{legacy}, c.MediaServers...)
+	}
+	if c.TelegramChatID != "" {
+		id := TelegramChatID(c.TelegramChatID)
+		listed := false
+		for _, chat := range c.TelegramChats {
+			listed = listed || chat.ID == id
+		}
+		if !listed {
+			c.TelegramChats = append([]TelegramChatConfig{{ID: id}}, c.TelegramChats...)
+		}
+	}
+	if c.TelegramAPIURL == "" {
+		c.TelegramAPIURL = "https://api.telegram.org"
+	}
+	for i := range c.TelegramUsers {
+		if c.TelegramUsers[i].Role == "" {
+			c.TelegramUsers[i].Role = TelegramRoleViewer
+		}
+	}
+	seenServers := make(map[string]bool)
+	for i := range c.MediaServers {
+		ms := &c.MediaServers[i]
+		if ms.Type == "" {
+			ms.Type = SourceTypePlex
+		}
+		if ms.Type == SourceTypePlex && ms.Token == "" {
+			ms.Token = c.PlexToken
+		}
+		if ms.Name == "" {
+			ms.Name = ms.Type
+		}
+		if seenServers[ms.Name] {
+			ms.Name = fmt.Sprintf("%s-%d", ms.Name, i+1)
+		}
+		seenServers[ms.Name] = true
+	}
+	seenNotifiers := make(map[string]bool)
+	for i := range c.Notifiers {
+		n := &c.Notifiers[i]
+		if n.Name == "" {
+			n.Name = n.Type
+		}
+		if seenNotifiers[n.Name] {
+			n.Name = fmt.Sprintf("%s-%d", n.Name, i+1)
+		}
+		seenNotifiers[n.Name] = true
+	}
+	seen := make(map[string]bool)
+	for i := range c.DownloadClients {
+		dc := &c.DownloadClients[i]
+		if dc.Name == "" {
+			dc.Name = dc.Type
+		}
+		if seen[dc.Name] {
+			dc.Name = fmt.Sprintf("%s-%d", dc.Name, i+1)
+		}
+		seen[dc.Name] = true
+	}
+	if c.ThrottleMode == "" {
+		c.ThrottleMode = ThrottleModeFixed
+	}
+	if c.ThrottleStrategy == "" {
+		c.ThrottleStrategy = ThrottleStrategyGlobalLimit
+	}
+	if c.MinStreamingUploadKbps <= 0 {
+		c.MinStreamingUploadKbps = 50
+	}
+	if c.FallbackStreamKbps <= 0 {
+		c.FallbackStreamKbps = 1250
+	}
 	if c.PollIntervalSec <= 0 {
 		c.PollIntervalSec = 60
 	}
@@ -91,7 +533,73 @@ func (c *Config) applyDefaults() {
 	if c.CooldownStatePath == "" {
 		c.CooldownStatePath = "cooldown_state.json"
 	}
+	if c.RuntimeStatePath == "" {
+		c.RuntimeStatePath = filepath.Join(filepath.Dir(c.CooldownStatePath), "runtime_state.json")
+	}
 	if c.ManualThrottleDefaultMinutes <= 0 {
 		c.ManualThrottleDefaultMinutes = 1440
 	}
 }
+
+func (c *Config) localLimits() Limits {
+	return Limits{UploadKbps: c.LocalStreamingUploadKbps, DownloadKbps: c.LocalStreamingDownloadKbps}
+}
+
+// decisionUploadKbps returns the streaming upload limit configured for a
+// playback decision, or 0 if it should use the profile's limit.
+func (c *Config) decisionUploadKbps(decision string) int {
+	switch decision {
+	case DecisionDirectPlay:
+		return c.DirectPlayUploadKbps
+	case DecisionDirectStream:
+		return c.DirectStreamUploadKbps
+	case DecisionTranscode:
+		return c.TranscodeUploadKbps
+	}
+	return 0
+}
+
+// location returns the time zone schedules are evaluated in, defaulting to
+// the system's local time.
+func (c *Config) location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", c.Timezone, err)
+	}
+	return loc, nil
+}
+
+// webhookAllowedNets parses webhook_allowed_cidrs.
+func (c *Config) webhookAllowedNets() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for i, cidr := range c.WebhookAllowedCIDRs {
+		n, err := parseNet(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("webhook_allowed_cidrs[%d]: %w", i, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseNet parses a CIDR, accepting a bare address as a single-host
+// network.
+func parseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deluge's Web UI reports "Not authenticated" with this JSON-RPC error code.
+const delugeErrNotAuthenticated = 1
+
+var errDelugeNotAuthenticated = errors.New("not authenticated")
+
+type DelugeClient struct {
+	name     string
+	baseURL  string
+	password string
+	client   *http.Client
+	mu       sync.Mutex
+	nextID   int
+}
+
+type delugeRequest struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	ID     int           `json:"id"`
+}
+
+type delugeResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	} `json:"error"`
+}
+
+func NewDelugeClient(name, baseURL, password string) (*DelugeClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating cookie jar: %w", err)
+	}
+
+	return &DelugeClient{
+		name:     name,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		password: password,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Jar:     jar,
+		},
+	}, nil
+}
+
+func (d *DelugeClient) Name() string {
+	return d.name
+}
+
+// Login authenticates against the Web UI and makes sure it is connected to
+// a daemon, connecting to the first configured host if it isn't.
+func (d *DelugeClient) Login() error {
+	var ok bool
+	if err := d.callOnce("auth.login", []interface{}{d.password}, &ok); err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("login failed - check password")
+	}
+
+	var connected bool
+	if err := d.callOnce("web.connected", []interface{}{}, &connected); err != nil {
+		return fmt.Errorf("checking daemon connection: %w", err)
+	}
+	if connected {
+		return nil
+	}
+
+	var hosts [][]interface{}
+	if err := d.callOnce("web.get_hosts", []interface{}{}, &hosts); err != nil {
+		return fmt.Errorf("listing daemon hosts: %w", err)
+	}
+	if len(hosts) == 0 || len(hosts[0]) == 0 {
+		return fmt.Errorf("no daemon hosts configured in Deluge Web UI")
+	}
+	if err := d.callOnce("web.connect", []interface{}{hosts[0][0]}, nil); err != nil {
+		return fmt.Errorf("connecting to daemon: %w", err)
+	}
+	return nil
+}
+
+func (d *DelugeClient) Ping() error {
+	var connected bool
+	if err := d.call("web.connected", []interface{}{}, &connected); err != nil {
+		return err
+	}
+	if !connected {
+		return fmt.Errorf("web UI is not connected to a daemon")
+	}
+	return nil
+}
+
+func (d *DelugeClient) SetUploadLimit(bytesPerSec int) error {
+	return d.setSpeed("max_upload_speed", bytesPerSec)
+}
+
+func (d *DelugeClient) GetUploadLimit() (int, error) {
+	return d.getSpeed("max_upload_speed")
+}
+
+func (d *DelugeClient) SetDownloadLimit(bytesPerSec int) error {
+	return d.setSpeed("max_download_speed", bytesPerSec)
+}
+
+func (d *DelugeClient) GetDownloadLimit() (int, error) {
+	return d.getSpeed("max_download_speed")
+}
+
+// setSpeed writes a global speed setting. Deluge uses KiB/s with -1 meaning
+// unlimited.
+func (d *DelugeClient) setSpeed(key string, bytesPerSec int) error {
+	value := float64(-1)
+	if bytesPerSec > 0 {
+		value = float64(bytesPerSec) / 1024
+	}
+	return d.call("core.set_config", []interface{}{map[string]interface{}{key: value}}, nil)
+}
+
+func (d *DelugeClient) getSpeed(key string) (int, error) {
+	var value float64
+	if err := d.call("core.get_config_value", []interface{}{key}, &value); err != nil {
+		return 0, err
+	}
+	if value <= 0 {
+		return 0, nil
+	}
+	return int(value * 1024), nil
+}
+
+// call performs a JSON-RPC request, logging in again and retrying once if
+// the session cookie has expired.
+func (d *DelugeClient) call(method string, params []interface{}, result interface{}) error {
+	err := d.callOnce(method, params, result)
+	if errors.Is(err, errDelugeNotAuthenticated) {
+		if loginErr := d.Login(); loginErr != nil {
+			return fmt.Errorf("re-login failed: %w", loginErr)
+		}
+		return d.callOnce(method, params, result)
+	}
+	return err
+}
+
+func (d *DelugeClient) callOnce(method string, params []interface{}, result interface{}) (err error) {
+	start := time.Now()
+	defer func() { observeRequest(d.name, start, err) }()
+
+	d.mu.Lock()
+	d.nextID++
+	id := d.nextID
+	d.mu.Unlock()
+
+	body, err := json.Marshal(delugeRequest{Method: method, Params: params, ID: id})
+	if err != nil {
+		return fmt.Errorf("marshaling request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", d.baseURL+"/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	var rpcResp delugeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	if rpcResp.Error != nil {
+		if rpcResp.Error.Code == delugeErrNotAuthenticated {
+			return errDelugeNotAuthenticated
+		}
+		return fmt.Errorf("%s failed: %s", method, rpcResp.Error.Message)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(rpcResp.Result, result); err != nil {
+			return fmt.Errorf("decoding result: %w", err)
+		}
+	}
+	return nil
+}
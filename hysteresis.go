@@ -0,0 +1,59 @@
+package main
+
+// Hysteresis counts consecutive observations that disagree with the current
+// state, so a single blip (e.g. a paused-then-resumed session) doesn't flip
+// the upload limit. It is only used from the main loop and is not safe for
+// concurrent use.
+type Hysteresis struct {
+	streamingThreshold int
+	idleThreshold      int
+	streamingCount     int
+	idleCount          int
+}
+
+type HysteresisStatus struct {
+	StreamingObservations int `json:"streaming_observations"`
+	StreamingThreshold    int `json:"streaming_threshold"`
+	IdleObservations      int `json:"idle_observations"`
+	IdleThreshold         int `json:"idle_threshold"`
+}
+
+func NewHysteresis(streamingThreshold, idleThreshold int) *Hysteresis {
+	return &Hysteresis{
+		streamingThreshold: streamingThreshold,
+		idleThreshold:      idleThreshold,
+	}
+}
+
+// Observe records one observation and reports whether enough consecutive
+// observations of the observed state have been seen to transition to it.
+func (h *Hysteresis) Observe(current, observed State) bool {
+	if observed == current {
+		h.Reset()
+		return false
+	}
+
+	if observed == StateStreaming {
+		h.streamingCount++
+		h.idleCount = 0
+		return h.streamingCount >= h.streamingThreshold
+	}
+
+	h.idleCount++
+	h.streamingCount = 0
+	return h.idleCount >= h.idleThreshold
+}
+
+func (h *Hysteresis) Reset() {
+	h.streamingCount = 0
+	h.idleCount = 0
+}
+
+func (h *Hysteresis) Status() HysteresisStatus {
+	return HysteresisStatus{
+		StreamingObservations: h.streamingCount,
+		StreamingThreshold:    h.streamingThreshold,
+		IdleObservations:      h.idleCount,
+		IdleThreshold:         h.idleThreshold,
+	}
+}
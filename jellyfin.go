@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JellyfinClient reads playback sessions from Jellyfin or Emby. Jellyfin is
+// a fork of Emby and both serve the same /Sessions shape; they only differ
+// in how the API key is sent.
+type JellyfinClient struct {
+	name       string
+	sourceType string
+	baseURL    string
+	apiKey     string
+	client     *http.Client
+}
+
+type jellyfinSession struct {
+	UserName       string `json:"UserName"`
+	Client         string `json:"Client"`
+	DeviceID       string `json:"DeviceId"`
+	DeviceName     string `json:"DeviceName"`
+	RemoteEndPoint string `json:"RemoteEndPoint"`
+	NowPlayingItem *struct {
+		ID         string `json:"Id"`
+		Name       string `json:"Name"`
+		SeriesName string `json:"SeriesName"`
+	} `json:"NowPlayingItem"`
+	PlayState struct {
+		IsPaused   bool   `json:"IsPaused"`
+		PlayMethod string `json:"PlayMethod"`
+	} `json:"PlayState"`
+	TranscodingInfo *struct {
+		Bitrate int `json:"Bitrate"`
+	} `json:"TranscodingInfo"`
+}
+
+func NewJellyfinClient(name, sourceType, baseURL, apiKey string) *JellyfinClient {
+	return &JellyfinClient{
+		name:       name,
+		sourceType: sourceType,
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     apiKey,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (j *JellyfinClient) Name() string {
+	return j.name
+}
+
+func (j *JellyfinClient) Type() string {
+	return j.sourceType
+}
+
+func (j *JellyfinClient) Identity() (string, error) {
+	var info struct {
+		ID string `json:"Id"`
+	}
+	if err := j.get("/System/Info/Public", &info); err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// GetSessions returns the sessions that are playing something. Neither
+// server says whether a client is local, so that is decided by whether it
+// connects from a private address.
+func (j *JellyfinClient) GetSessions() ([]Session, error) {
+	var sessions []jellyfinSession
+	if err := j.get("/Sessions", &sessions); err != nil {
+		return nil, err
+	}
+
+	var result []Session
+	for _, s := range sessions {
+		item := s.NowPlayingItem
+		if item == nil {
+			continue
+		}
+
+		session := Session{
+			Server:    j.name,
+			Key:       s.DeviceID + "/" + item.ID,
+			PlayerID:  s.DeviceID,
+			RatingKey: item.ID,
+			Title:     displayTitle(item.SeriesName, item.Name),
+			User:      s.UserName,
+			Player:    s.DeviceName,
+			Product:   s.Client,
+			Address:   endpointHost(s.RemoteEndPoint),
+			Remote:    !isPrivateAddress(endpointHost(s.RemoteEndPoint)),
+			State:     "playing",
+			Decision:  jellyfinDecision(s.PlayState.PlayMethod),
+		}
+		if s.PlayState.IsPaused {
+			session.State = "paused"
+		}
+		if s.TranscodingInfo != nil && s.TranscodingInfo.Bitrate > 0 {
+			session.BandwidthKbps = s.TranscodingInfo.Bitrate / 8 / 1024
+		}
+		result = append(result, session)
+	}
+	return result, nil
+}
+
+func (j *JellyfinClient) get(path string, result interface{}) (err error) {
+	start := time.Now()
+	defer func() { observeRequest(j.name, start, err) }()
+
+	req, err := http.NewRequest("GET", j.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	if j.sourceType == SourceTypeJellyfin {
+		req.Header.Set("Authorization", fmt.Sprintf("MediaBrowser Token=%q", j.apiKey))
+	} else {
+		req.Header.Set("X-Emby-Token", j.apiKey)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := j.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("invalid %s api key (401)", j.sourceType)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+func jellyfinDecision(playMethod string) string {
+	switch playMethod {
+	case "DirectPlay":
+		return DecisionDirectPlay
+	case "DirectStream":
+		return DecisionDirectStream
+	case "Transcode":
+		return DecisionTranscode
+	}
+	return ""
+}
+
+// endpointHost strips the port from an "ip:port" endpoint, if there is one.
+func endpointHost(endpoint string) string {
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		return host
+	}
+	return endpoint
+}
+
+// isPrivateAddress reports whether addr is a loopback, link-local or
+// private (RFC 1918/4193) address. An empty or unparseable address is
+// treated as remote.
+func isPrivateAddress(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	plexTVURL        = "https://plex.tv"
+	plexProduct      = "plex-helper"
+	pinPollInterval  = 2 * time.Second
+	loginHintMessage = "run 'plex-helper login' to get a new token"
+)
+
+// PlexAuth obtains a Plex token through the PIN flow described in
+// docs/plex_api_summary.md.
+type PlexAuth struct {
+	clientID string
+	client   *http.Client
+}
+
+type plexPin struct {
+	ID        int       `json:"id"`
+	Code      string    `json:"code"`
+	AuthToken string    `json:"authToken"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func NewPlexAuth() (*PlexAuth, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generating client identifier: %w", err)
+	}
+	return &PlexAuth{
+		clientID: hex.EncodeToString(id),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// RequestPin creates a short PIN that can be entered at plex.tv/link.
+func (a *PlexAuth) RequestPin() (*plexPin, error) {
+	var pin plexPin
+	if err := a.do("POST", "/api/v2/pins", "", &pin); err != nil {
+		return nil, err
+	}
+	return &pin, nil
+}
+
+// WaitForToken polls the PIN until it has been linked to an account or has
+// expired.
+func (a *PlexAuth) WaitForToken(pin *plexPin) (string, error) {
+	for time.Now().Before(pin.ExpiresAt) {
+		var status plexPin
+		path := fmt.Sprintf("/api/v2/pins/%d?%s", pin.ID, url.Values{"code": {pin.Code}}.Encode())
+		if err := a.do("GET", path, "", &status); err != nil {
+			return "", err
+		}
+		if status.AuthToken != "" {
+			return status.AuthToken, nil
+		}
+		time.Sleep(pinPollInterval)
+	}
+	return "", fmt.Errorf("code %s expired before it was linked", pin.Code)
+}
+
+// Verify checks that the token is accepted by plex.tv and returns the
+// account's username.
+func (a *PlexAuth) Verify(token string) (string, error) {
+	var user struct {
+		Username string `json:"username"`
+	}
+	if err := a.do("GET", "/api/v2/user", token, &user); err != nil {
+		return "", err
+	}
+	return user.Username, nil
+}
+
+func (a *PlexAuth) do(method, path, token string, result interface{}) error {
+	req, err := http.NewRequest(method, plexTVURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Plex-Product", plexProduct)
+	req.Header.Set("X-Plex-Client-Identifier", a.clientID)
+	if token != "" {
+		req.Header.Set("X-Plex-Token", token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errPlexUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// runLogin implements the login subcommand: it links plex-helper to a Plex
+// account and saves the token to the config file, or to a separate token
+// file referenced from it.
+func runLogin(defaultConfigPath string, args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	configPath := fs.String("config", defaultConfigPath, "path to config file to save the token to")
+	tokenFile := fs.String("token-file", "", "save the token to this file and point plex_token_file at it instead")
+	fs.Parse(args)
+
+	auth, err := NewPlexAuth()
+	if err != nil {
+		return err
+	}
+
+	pin, err := auth.RequestPin()
+	if err != nil {
+		return fmt.Errorf("requesting PIN: %w", err)
+	}
+	fmt.Printf("Go to https://plex.tv/link and enter the code: %s\n", pin.Code)
+	fmt.Println("Waiting for the code to be linked...")
+
+	token, err := auth.WaitForToken(pin)
+	if err != nil {
+		return fmt.Errorf("waiting for PIN: %w", err)
+	}
+
+	username, err := auth.Verify(token)
+	if err != nil {
+		return fmt.Errorf("verifying token: %w", err)
+	}
+	fmt.Printf("Logged in as %s\n", username)
+
+	if *tokenFile != "" {
+		if err := os.WriteFile(*tokenFile, []byte(token+"\n"), 0600); err != nil {
+			return fmt.Errorf("writing token file: %w", err)
+		}
+		path, err := filepath.Abs(*tokenFile)
+		if err != nil {
+			return fmt.Errorf("resolving token file: %w", err)
+		}
+		if err := setConfigValue(*configPath, "plex_token_file", path); err != nil {
+			return err
+		}
+		fmt.Printf("Token saved to %s\n", *tokenFile)
+		return nil
+	}
+
+	if err := setConfigValue(*configPath, "plex_token", token); err != nil {
+		return err
+	}
+	fmt.Printf("Token saved to %s\n", *configPath)
+	return nil
+}
+
+// setConfigValue sets a top-level key in a JSON config file, editing the
+// file in place so the rest of its layout is preserved. A missing file is
+// created.
+func setConfigValue(path, key string, value interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		data = []byte("{}\n")
+	} else if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", key, err)
+	}
+
+	updated, err := replaceJSONValue(data, key, encoded)
+	if err != nil {
+		return fmt.Errorf("updating config file: %w", err)
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, updated, mode); err != nil {
+		return fmt.Errorf("writing config file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing config file: %w", err)
+	}
+	return nil
+}
+
+// replaceJSONValue replaces the value of a top-level key in a JSON object,
+// or adds the key at the top of the object if it isn't there.
+func replaceJSONValue(data []byte, key string, value []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	open := int(dec.InputOffset())
+
+	empty := true
+	for dec.More() {
+		empty = false
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if tok != key {
+			continue
+		}
+		end := int(dec.InputOffset())
+		start := end - len(raw)
+		return append(append(append([]byte{}, data[:start]...), value...), data[end:]...), nil
+	}
+
+	entry := fmt.Sprintf("%q: %s", key, value)
+	if empty {
+		return append(append([]byte{}, data[:open]...), append([]byte("\n    "+entry+"\n"), data[open:]...)...), nil
+	}
+	// Reuse the whitespace in front of the first key so the new line is
+	// indented like the others.
+	rest := data[open:]
+	indent := rest[:len(rest)-len(bytes.TrimLeft(rest, " \t\r\n"))]
+	out := append([]byte{}, data[:open]...)
+	out = append(out, indent...)
+	out = append(out, entry+","...)
+	return append(out, rest...), nil
+}
+
+// loginHint adds a pointer to the login subcommand to errors caused by an
+// invalid or expired Plex token.
+func loginHint(err error) string {
+	if errors.Is(err, errPlexUnauthorized) {
+		return fmt.Sprintf("%v (%s)", err, loginHintMessage)
+	}
+	return err.Error()
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestReplaceJSONValue(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "key present",
+			data: "{\n    \"plex_url\": \"http://plex:32400\",\n    \"plex_token\": \"old\",\n    \"poll_interval_sec\": 30\n}\n",
+			want: "{\n    \"plex_url\": \"http://plex:32400\",\n    \"plex_token\": \"new\",\n    \"poll_interval_sec\": 30\n}\n",
+		},
+		{
+			name: "key present with non-string value",
+			data: `{"plex_token": null, "a": 1}`,
+			want: `{"plex_token": "new", "a": 1}`,
+		},
+		{
+			name: "key missing",
+			data: "{\n    \"plex_url\": \"http://plex:32400\"\n}\n",
+			want: "{\n    \"plex_token\": \"new\",\n    \"plex_url\": \"http://plex:32400\"\n}\n",
+		},
+		{
+			name: "key only in a nested object",
+			data: `{"media_servers": [{"plex_token": "inner"}]}`,
+			want: `{"plex_token": "new","media_servers": [{"plex_token": "inner"}]}`,
+		},
+		{
+			name: "empty object",
+			data: "{}\n",
+			want: "{\n    \"plex_token\": \"new\"\n}\n",
+		},
+		{
+			name: "odd whitespace",
+			data: "{  \"a\" :1,\"plex_token\"  :\t\"old\"  }",
+			want: "{  \"a\" :1,\"plex_token\"  :\t\"new\"  }",
+		},
+		{
+			name: "tab indented, key missing",
+			data: "{\n\t\"a\": 1\n}",
+			want: "{\n\t\"plex_token\": \"new\",\n\t\"a\": 1\n}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := replaceJSONValue([]byte(tt.data), "plex_token", []byte(`"new"`))
+			if err != nil {
+				t.Fatalf("replaceJSONValue: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceJSONValueNotObject(t *testing.T) {
+	for _, data := range []string{"", "[]", `"plex_token"`} {
+		if _, err := replaceJSONValue([]byte(data), "plex_token", []byte(`"new"`)); err == nil {
+			t.Errorf("replaceJSONValue(%q) succeeded, want error", data)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -31,83 +35,202 @@ func main() {
 	verbose := flag.Bool("verbose", false, "enable verbose logging")
 	flag.Parse()
 
+	if flag.Arg(0) == "login" {
+		if err := runLogin(*configPath, flag.Args()[1:]); err != nil {
+			log.Fatalf("Login failed: %v", err)
+		}
+		return
+	}
+
 	cfg, err := LoadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	plex := NewPlexClient(cfg.PlexURL, cfg.PlexToken)
+	schedule, err := NewSchedule(cfg)
+	if err != nil {
+		log.Fatalf("Invalid schedule: %v", err)
+	}
 
-	qbt, err := NewQBittorrentClient(cfg.QBittorrentURL, cfg.QBittorrentUsername, cfg.QBittorrentPassword)
+	sessionRules, err := NewSessionRules(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create qBittorrent client: %v", err)
+		log.Fatalf("Invalid session rules: %v", err)
 	}
 
-	if cfg.QBittorrentUsername != "" {
-		if err := qbt.Login(); err != nil {
-			log.Fatalf("Failed to login to qBittorrent: %v", err)
-		}
-		log.Println("Logged in to qBittorrent")
+	sources, err := NewMediaSources(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create media server clients: %v", err)
+	}
+	sources.Identify()
+
+	throttlers, err := NewThrottleGroup(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create download clients: %v", err)
 	}
 
-	telegram := NewTelegramClient(cfg.TelegramBotToken, cfg.TelegramChatID)
+	if err := throttlers.Login(); err != nil {
+		log.Fatalf("Failed to login to download client: %v", err)
+	}
+
+	telegramCmdCh := make(chan TelegramCommand, 1)
+	telegram, err := NewTelegramClient(cfg, telegramCmdCh)
+	if err != nil {
+		log.Fatalf("Failed to create Telegram client: %v", err)
+	}
 	if telegram != nil {
 		log.Println("Telegram notifications enabled")
 	}
 
 	appState := NewAppState()
+	hysteresis := NewHysteresis(cfg.StreamingThreshold, cfg.IdleThreshold)
+	appState.SetHysteresis(hysteresis.Status())
 	cooldown := NewCooldownTracker(cfg.CooldownMaxTransitions, cfg.CooldownWindowMinutes, cfg.CooldownStatePath)
 	manualThrottle := NewManualThrottle()
-	eventCh := make(chan string, 1)
-	telegramCmdCh := make(chan TelegramCommand, 1)
+	registerStateMetrics(appState, manualThrottle, cooldown)
+	eventCh := make(chan WebhookEvent, 16)
 	manualExpiryCh := make(chan struct{}, 1)
 	var expiryTimer *time.Timer
 
 	if cfg.HealthPort > 0 {
-		server := NewServer(cfg.HealthPort, appState, plex, qbt, eventCh, manualThrottle)
+		webhookNets, err := cfg.webhookAllowedNets()
+		if err != nil {
+			log.Fatalf("Invalid webhook_allowed_cidrs: %v", err)
+		}
+		if cfg.WebhookToken == "" {
+			log.Println("Warning: webhook_token is not set, webhooks are accepted without authentication")
+		}
+		server := NewServer(cfg.HealthPort, appState, sources, throttlers, eventCh, manualThrottle, telegram, cfg.WebhookToken, webhookNets)
 		server.Start()
 	}
 
-	if telegram != nil {
-		defaultDuration := time.Duration(cfg.ManualThrottleDefaultMinutes) * time.Minute
-		go telegram.StartPolling(telegramCmdCh, defaultDuration)
-		log.Println("Telegram command polling started")
+	telegram.Start()
+	defer telegram.Stop()
+
+	notifiers, err := NewNotifiers(cfg, telegram)
+	if err != nil {
+		log.Fatalf("Failed to create notifiers: %v", err)
 	}
+	defer notifiers.Close()
 
 	state := StateIdle
-	currentLimitKbps := cfg.IdleUploadKbps
+	profile := schedule.Current()
+	currentLimits := profile.Idle
+	appState.SetProfile(profile.Name)
+	sessionTable := NewSessionTable()
+	runtimeStore := NewRuntimeStore(cfg.RuntimeStatePath)
+
+	// persist saves everything needed to resume after a restart. Dry runs
+	// never change any limits, so there is nothing worth saving.
+	persist := func() {
+		if *dryRun {
+			return
+		}
+
+		rs := &RuntimeState{
+			State:           state.String(),
+			UploadKbps:      currentLimits.UploadKbps,
+			DownloadKbps:    currentLimits.DownloadKbps,
+			TorrentPolicies: throttlers.PolicySnapshots(),
+		}
+		if active, expiresAt, triggeredBy := manualThrottle.GetInfo(); active {
+			rs.ManualThrottle = &ManualThrottleState{ExpiresAt: expiresAt, TriggeredBy: triggeredBy}
+		}
+		runtimeStore.Save(rs)
+	}
+
+	armExpiry := func(d time.Duration) {
+		if expiryTimer != nil {
+			expiryTimer.Stop()
+		}
+		expiryTimer = time.AfterFunc(d, func() {
+			select {
+			case manualExpiryCh <- struct{}{}:
+			default:
+			}
+		})
+	}
+
+	if saved := runtimeStore.Load(); saved != nil {
+		state = parseState(saved.State)
+		currentLimits = Limits{UploadKbps: saved.UploadKbps, DownloadKbps: saved.DownloadKbps}
+		throttlers.LoadPolicySnapshots(saved.TorrentPolicies)
+		appState.Update(state, StreamCounts{}, currentLimits)
+		log.Printf("Restored runtime state: %s (%s)", state, currentLimits)
+
+		if m := saved.ManualThrottle; m != nil {
+			manualThrottle.Restore(m.ExpiresAt, m.TriggeredBy)
+			remaining := time.Until(m.ExpiresAt)
+			if remaining > 0 {
+				log.Printf("Restored manual throttle by %s (%s remaining)", m.TriggeredBy, formatDuration(remaining))
+			} else {
+				log.Printf("Manual throttle by %s expired while stopped", m.TriggeredBy)
+				remaining = 0
+			}
+			armExpiry(remaining)
+		}
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	check := func() bool {
-		if manualThrottle.IsActive() {
-			if *verbose {
-				log.Println("Manual throttle active, skipping Plex check")
+	// reconcile re-applies the current limits to any download client whose
+	// actual limits no longer match, e.g. after a change in its WebUI or a
+	// restart. While streaming it also applies the torrent policies to
+	// torrents added since.
+	reconcile := func() {
+		if *dryRun {
+			return
+		}
+
+		if state == StateStreaming {
+			before := throttlers.PolicyTorrents()
+			if err := throttlers.ApplyPolicies(true); err != nil {
+				log.Printf("Error applying torrent policies: %v", err)
+			}
+			if throttlers.PolicyTorrents() != before {
+				persist()
 			}
-			return false
 		}
 
-		remoteStreams, err := plex.GetRemoteStreamCount()
-		if err != nil {
-			log.Printf("Error checking Plex: %v", err)
-			return false
+		corrected := throttlers.Reconcile(state == StateStreaming, currentLimits)
+		if len(corrected) == 0 {
+			return
 		}
 
-		appState.Update(state, remoteStreams, currentLimitKbps)
+		appState.AddDriftCorrections(len(corrected))
+		notifiers.Send(Notification{Kind: NotifyDrift, Title: "Limit drift corrected", Body: strings.Join(corrected, "\n")})
+	}
+
+	// decide applies the state implied by the given sessions. Unless
+	// bypassHysteresis is set, a transition only happens once the new state
+	// has been observed streaming_threshold/idle_threshold times in a row.
+	decide := func(sessions []Session, bypassHysteresis bool) bool {
+		verdicts := sessionRules.Evaluate(sessions)
+		streams, remoteActive, localActive := countedStreams(verdicts)
+
+		appState.Update(state, streams, currentLimits)
+		appState.SetSessions(verdicts)
 
 		if *verbose {
-			log.Printf("Remote streams: %d, state: %s", remoteStreams, state)
+			log.Printf("Remote streams: %d, local streams: %d, state: %s", streams.Remote, streams.Local, state)
 		}
 
 		var newState State
-		if remoteStreams > 0 {
+		if remoteActive || localActive {
 			newState = StateStreaming
 		} else {
 			newState = StateIdle
 		}
 
-		if newState == state {
+		confirmed := hysteresis.Observe(state, newState)
+		appState.SetHysteresis(hysteresis.Status())
+		if newState != state && !confirmed && !bypassHysteresis {
+			if *verbose {
+				status := hysteresis.Status()
+				log.Printf("Observed %s (streaming %d/%d, idle %d/%d), waiting before transition",
+					newState, status.StreamingObservations, status.StreamingThreshold,
+					status.IdleObservations, status.IdleThreshold)
+			}
 			return false
 		}
 
@@ -119,50 +242,152 @@ func main() {
 			}
 		}
 
-		var limitKbps int
+		// The profile is re-read even if its name didn't change, since /set
+		// may have changed its limits.
+		profileChanged := false
+		current := schedule.Current()
+		if current.Name != profile.Name {
+			log.Printf("Schedule profile: %s -> %s", profile.Name, current.Name)
+			profileChanged = true
+			appState.SetProfile(current.Name)
+		}
+		profile = current
+
+		var limits Limits
 		if newState == StateStreaming {
-			limitKbps = cfg.StreamingUploadKbps
+			if remoteActive {
+				limits = Limits{
+					UploadKbps:   streamingLimitKbps(cfg, profile, verdicts),
+					DownloadKbps: profile.Streaming.DownloadKbps,
+				}
+			}
+			if localActive {
+				limits = minLimits(limits, cfg.localLimits())
+			}
 		} else {
-			limitKbps = cfg.IdleUploadKbps
+			limits = profile.Idle
 		}
 
-		limitBytes := limitKbps * 1024
+		if newState == state {
+			// With alt_speed the effective limits are owned by qBittorrent,
+			// so there is nothing to adjust within a state.
+			if limits == currentLimits || cfg.ThrottleStrategy == ThrottleStrategyAltSpeed {
+				return false
+			}
+
+			log.Printf("Adjusting limits: %s -> %s (%d remote, %d local streams, profile %s)",
+				currentLimits, limits, streams.Remote, streams.Local, profile.Name)
 
-		limitStr := fmt.Sprintf("%d KB/s", limitKbps)
-		if limitKbps == 0 {
-			limitStr = "unlimited"
+			if !*dryRun {
+				if _, err := throttlers.Apply(state == StateStreaming, limits); err != nil {
+					log.Printf("Error applying throttle: %v", err)
+					return false
+				}
+				if profileChanged {
+					notifiers.Send(Notification{
+						Kind:  NotifySchedule,
+						Title: "Schedule profile: " + profile.Name,
+						Body:  fmt.Sprintf("Limits set to %s", limits),
+					})
+				}
+			} else {
+				log.Printf("[DRY RUN] Would set limits to %s", limits)
+			}
+
+			currentLimits = limits
+			appState.Update(state, streams, currentLimits)
+			persist()
+			return true
 		}
 
-		log.Printf("State change: %s -> %s (setting upload limit to %s)", state, newState, limitStr)
+		streaming := newState == StateStreaming
+		log.Printf("State change: %s -> %s (%s)", state, newState, describeAction(cfg.ThrottleStrategy, streaming, limits))
 
 		if !*dryRun {
-			if err := qbt.SetUploadLimit(limitBytes); err != nil {
-				log.Printf("Error setting upload limit: %v", err)
+			applied, err := throttlers.Apply(streaming, limits)
+			if err != nil {
+				log.Printf("Error applying throttle: %v", err)
 				return false
 			}
+			limits = applied
+			limitStr := describeLimit(cfg.ThrottleStrategy, streaming, limits)
 
-			var msg string
-			if newState == StateStreaming {
-				msg = fmt.Sprintf("*Streaming detected*\nThrottling upload to %s", limitStr)
-			} else {
-				msg = fmt.Sprintf("*Streaming ended*\nRestoring upload to %s", limitStr)
+			if err := throttlers.ApplyPolicies(streaming); err != nil {
+				log.Printf("Error applying torrent policies: %v", err)
 			}
-			if err := telegram.SendMessage(msg); err != nil {
-				log.Printf("Error sending Telegram notification: %v", err)
+
+			msg := Notification{Kind: NotifyStreaming, Title: "Streaming ended", Body: "Restoring to " + limitStr}
+			if streaming {
+				msg.Title, msg.Body = "Streaming detected", "Throttling to "+limitStr
 			}
+			if schedule.Enabled() {
+				msg.Body += fmt.Sprintf("\nProfile: %s", profile.Name)
+			}
+			if streaming {
+				msg.Sessions = countedSessions(verdicts)
+				if len(msg.Sessions) > 0 {
+					msg.Body += "\n\n" + formatStreams(msg.Sessions)
+				}
+				if cfg.NotificationPosters {
+					msg.Poster = posterFor(sources, msg.Sessions)
+				}
+			}
+			notifiers.Send(msg)
 		} else {
-			log.Printf("[DRY RUN] Would set upload limit to %s", limitStr)
+			log.Printf("[DRY RUN] Would %s", describeAction(cfg.ThrottleStrategy, streaming, limits))
 		}
 
 		if state == StateStreaming && newState == StateIdle {
 			cooldown.RecordTransition()
 		}
+		stateTransitions.Inc(state.String(), newState.String())
 		state = newState
-		currentLimitKbps = limitKbps
+		currentLimits = limits
+		hysteresis.Reset()
+		appState.Update(state, streams, currentLimits)
+		appState.SetHysteresis(hysteresis.Status())
+		persist()
 		return true
 	}
 
-	check()
+	// evaluate polls the media servers, corrects the session table with what
+	// they report and applies any resulting state change.
+	evaluate := func(bypassHysteresis bool) bool {
+		if manualThrottle.IsActive() {
+			if *verbose {
+				log.Println("Manual throttle active, skipping media server check")
+			}
+			return false
+		}
+
+		// A server that can't be reached keeps its last known sessions
+		// rather than looking idle.
+		reached := 0
+		for _, poll := range sources.Poll() {
+			if poll.Err != nil {
+				log.Printf("Error checking %s: %s", poll.Server, loginHint(poll.Err))
+				continue
+			}
+			sessionTable.Reconcile(poll.Server, poll.Sessions)
+			reached++
+		}
+		if reached == 0 {
+			return false
+		}
+		return decide(sessionTable.Sessions(), bypassHysteresis)
+	}
+
+	// check runs evaluate and, when it didn't change anything, verifies the
+	// download clients still have the limits we last applied.
+	check := func(bypassHysteresis bool) bool {
+		if evaluate(bypassHysteresis) {
+			return true
+		}
+		reconcile()
+		return false
+	}
+
+	check(true)
 
 	if *once {
 		return
@@ -173,7 +398,55 @@ func main() {
 	fallbackTicker := time.NewTicker(time.Duration(cfg.PollIntervalSec) * time.Second)
 	defer fallbackTicker.Stop()
 
+	// statusText renders the /status reply, which the status keyboard
+	// refreshes in place.
+	statusText := func() string {
+		_, _, streams, limits, startTime := appState.Get()
+		uptime := time.Since(startTime).Round(time.Second)
+
+		var statusMsg string
+		if manualThrottle.IsActive() {
+			remaining := manualThrottle.TimeRemaining()
+			statusMsg = fmt.Sprintf("*Status*\nState: manual throttle\nUpload limit: %s\nDownload limit: %s\nTime remaining: %s\nRemote streams: %d\nUptime: %s",
+				formatLimit(limits.UploadKbps), formatLimit(limits.DownloadKbps), formatDuration(remaining), streams.Remote, uptime)
+		} else {
+			statusMsg = fmt.Sprintf("*Status*\nState: %s\nUpload limit: %s\nDownload limit: %s\nRemote streams: %d\nUptime: %s",
+				state, formatLimit(limits.UploadKbps), formatLimit(limits.DownloadKbps), streams.Remote, uptime)
+		}
+		if cfg.LocalProtection {
+			statusMsg += fmt.Sprintf("\nLocal streams: %d", streams.Local)
+		}
+		if schedule.Enabled() {
+			statusMsg += fmt.Sprintf("\nProfile: %s", escapeMarkdown(appState.Profile()))
+		}
+		if sessions := appState.Sessions(); len(sessions) > 0 {
+			statusMsg += "\n\n*Sessions*\n" + formatSessions(sessions)
+		}
+		return statusMsg
+	}
+
+	// reply answers a command. A button press on the status message gets a
+	// short notification instead, and the status message is refreshed.
+	reply := func(cmd TelegramCommand, text string) {
+		if cmd.CallbackID == "" {
+			telegram.SendReply(cmd.ChatID, text)
+			return
+		}
+		telegram.AnswerCallback(cmd.CallbackID, strings.ReplaceAll(text, "*", ""))
+		telegram.EditStatus(cmd.ChatID, cmd.MessageID, statusText())
+	}
+
 	handleTelegramCommand := func(cmd TelegramCommand) {
+		if ok, why := telegram.Authorize(cmd); !ok {
+			log.Printf("Warning: rejected Telegram /%s from %s (%d)", cmd.Command, cmd.Username, cmd.UserID)
+			if cmd.CallbackID != "" {
+				telegram.AnswerCallback(cmd.CallbackID, why)
+			} else {
+				telegram.SendReply(cmd.ChatID, why)
+			}
+			return
+		}
+
 		switch cmd.Command {
 		case "limit":
 			if expiryTimer != nil {
@@ -182,40 +455,42 @@ func main() {
 
 			manualThrottle.Activate(cmd.Duration, cmd.Username)
 
-			limitKbps := cfg.StreamingUploadKbps
-			limitBytes := limitKbps * 1024
-			limitStr := fmt.Sprintf("%d KB/s", limitKbps)
-			if limitKbps == 0 {
-				limitStr = "unlimited"
-			}
+			limits := schedule.Current().Streaming
 
 			log.Printf("Manual throttle activated by %s for %s", cmd.Username, cmd.Duration)
 
 			if !*dryRun {
-				if err := qbt.SetUploadLimit(limitBytes); err != nil {
-					log.Printf("Error setting upload limit: %v", err)
-					telegram.SendReply(cmd.ChatID, fmt.Sprintf("Error setting limit: %v", err))
+				applied, err := throttlers.Apply(true, limits)
+				if err != nil {
+					log.Printf("Error applying throttle: %v", err)
+					reply(cmd, fmt.Sprintf("Error setting limit: %v", err))
 					return
 				}
+				limits = applied
+				if err := throttlers.ApplyPolicies(true); err != nil {
+					log.Printf("Error applying torrent policies: %v", err)
+				}
 			}
 
-			currentLimitKbps = limitKbps
+			currentLimits = limits
+			if state != StateStreaming {
+				stateTransitions.Inc(state.String(), StateStreaming.String())
+			}
 			state = StateStreaming
-			appState.Update(state, 0, currentLimitKbps)
+			hysteresis.Reset()
+			appState.Update(state, StreamCounts{}, currentLimits)
+			appState.SetHysteresis(hysteresis.Status())
+			persist()
 
-			expiryTimer = time.AfterFunc(cmd.Duration, func() {
-				select {
-				case manualExpiryCh <- struct{}{}:
-				default:
-				}
-			})
+			armExpiry(cmd.Duration)
 
-			msg := fmt.Sprintf("*Manual throttle activated*\nDuration: %s\nUpload limited to %s", formatDuration(cmd.Duration), limitStr)
-			telegram.SendReply(cmd.ChatID, msg)
+			msg := fmt.Sprintf("*Manual throttle activated*\nDuration: %s\nLimited to %s",
+				formatDuration(cmd.Duration), describeLimit(cfg.ThrottleStrategy, true, limits))
+			reply(cmd, msg)
 
 		case "unlimit":
 			if !manualThrottle.IsActive() {
-				telegram.SendReply(cmd.ChatID, "Manual throttle is not currently active.")
+				reply(cmd, "Manual throttle is not currently active.")
 				return
 			}
 
@@ -226,72 +501,113 @@ func main() {
 
 			log.Printf("Manual throttle cancelled by %s", cmd.Username)
 
-			check()
+			check(true)
+			persist()
+
+			msg := fmt.Sprintf("*Manual throttle cancelled*\nRestored to %s state (%s)", state, currentLimits)
+			reply(cmd, msg)
 
-			limitStr := fmt.Sprintf("%d KB/s", currentLimitKbps)
-			if currentLimitKbps == 0 {
-				limitStr = "unlimited"
+		case "set":
+			if cfg.ThrottleStrategy == ThrottleStrategyAltSpeed {
+				reply(cmd, "Limits are set in the download client with the alt\\_speed strategy.")
+				return
+			}
+			if !slices.Contains(baseLimitSettings, cmd.Setting) || cmd.Value < 0 {
+				base := schedule.Base()
+				lines := make([]string, 0, len(baseLimitSettings))
+				for _, setting := range baseLimitSettings {
+					lines = append(lines, fmt.Sprintf("• %s: %s", escapeMarkdown(setting), formatLimit(*base.limit(setting))))
+				}
+				reply(cmd, "Usage: /set <setting> <KB/s or unlimited>\n"+strings.Join(lines, "\n"))
+				return
 			}
-			msg := fmt.Sprintf("*Manual throttle cancelled*\nRestored to %s state (%s)", state, limitStr)
-			telegram.SendReply(cmd.ChatID, msg)
 
-		case "status":
-			_, _, remoteStreams, uploadLimit, startTime := appState.Get()
-			uptime := time.Since(startTime).Round(time.Second)
+			if err := schedule.SetBaseLimit(cmd.Setting, cmd.Value); err != nil {
+				reply(cmd, fmt.Sprintf("Error changing %s: %v", escapeMarkdown(cmd.Setting), err))
+				return
+			}
+			log.Printf("%s set to %s by %s", cmd.Setting, formatLimit(cmd.Value), cmd.Username)
 
-			limitStr := fmt.Sprintf("%d KB/s", uploadLimit)
-			if uploadLimit == 0 {
-				limitStr = "unlimited"
+			msg := fmt.Sprintf("*Setting changed*\n%s: %s", escapeMarkdown(cmd.Setting), formatLimit(cmd.Value))
+			if err := setConfigValue(*configPath, cmd.Setting, cmd.Value); err != nil {
+				log.Printf("Error saving %s to config: %v", cmd.Setting, err)
+				msg += "\nNot saved to the config file, so it is lost on restart."
 			}
 
-			var statusMsg string
-			if manualThrottle.IsActive() {
-				remaining := manualThrottle.TimeRemaining()
-				statusMsg = fmt.Sprintf("*Status*\nState: manual throttle\nUpload limit: %s\nTime remaining: %s\nRemote streams: %d\nUptime: %s",
-					limitStr, formatDuration(remaining), remoteStreams, uptime)
-			} else {
-				statusMsg = fmt.Sprintf("*Status*\nState: %s\nUpload limit: %s\nRemote streams: %d\nUptime: %s",
-					state, limitStr, remoteStreams, uptime)
+			if !manualThrottle.IsActive() {
+				check(false)
+			}
+			msg += fmt.Sprintf("\nCurrent limits: %s", currentLimits)
+			reply(cmd, msg)
+
+		case "status":
+			if cmd.CallbackID == "" {
+				telegram.SendStatus(cmd.ChatID, statusText())
+				return
 			}
-			telegram.SendReply(cmd.ChatID, statusMsg)
+			telegram.AnswerCallback(cmd.CallbackID, "")
+			telegram.EditStatus(cmd.ChatID, cmd.MessageID, statusText())
+		}
+	}
+
+	// handleWebhook updates the session table straight from the payload. A
+	// remote player starting or resuming playback throttles immediately; the
+	// next poll corrects the table if the webhook was wrong.
+	handleWebhook := func(event WebhookEvent) {
+		server, ok := sources.ServerFor(event.SourceType, event.ServerUUID)
+		if !ok {
+			log.Printf("Warning: ignoring webhook from unknown %s server %q", event.SourceType, event.ServerUUID)
+			return
+		}
+		event.Server = server
+
+		if event.PlayerID == "" {
+			// Nothing to key the session on, so poll the servers instead.
+			check(false)
+			return
+		}
+		if !sessionTable.ApplyWebhook(event) {
+			return
 		}
+		log.Printf("Webhook: %s on %s by %s on %s: %s (local=%v)",
+			event.Event, event.Server, event.Account, event.PlayerTitle, event.Title, event.Local)
+		if manualThrottle.IsActive() {
+			return
+		}
+		// Only the move into streaming skips hysteresis. While already
+		// streaming, a play from a session the rules don't count must not
+		// drop straight to idle.
+		remotePlay := !event.Local && (event.Event == "media.play" || event.Event == "media.resume")
+		decide(sessionTable.Sessions(), remotePlay && state != StateStreaming)
 	}
 
 	handleManualExpiry := func() {
-		if !manualThrottle.IsActive() {
+		if !manualThrottle.IsSet() {
 			return
 		}
 
 		manualThrottle.Deactivate()
 		log.Println("Manual throttle expired")
 
-		check()
+		check(true)
+		persist()
 
-		limitStr := fmt.Sprintf("%d KB/s", currentLimitKbps)
-		if currentLimitKbps == 0 {
-			limitStr = "unlimited"
-		}
-		msg := fmt.Sprintf("*Manual throttle expired*\nRestored to %s state (%s)", state, limitStr)
-		telegram.SendMessage(msg)
+		notifiers.Send(Notification{
+			Kind:  NotifyManual,
+			Title: "Manual throttle expired",
+			Body:  fmt.Sprintf("Restored to %s state (%s)", state, currentLimits),
+		})
 	}
 
 	for {
 		select {
 		case event := <-eventCh:
-			if *verbose {
-				log.Printf("Webhook event: %s", event)
-			}
-			for i := 0; i < 5; i++ {
-				time.Sleep(500 * time.Millisecond)
-				if check() {
-					break
-				}
-			}
+			handleWebhook(event)
 		case <-fallbackTicker.C:
 			if *verbose {
 				log.Println("Fallback poll triggered")
 			}
-			check()
+			check(false)
 		case cmd := <-telegramCmdCh:
 			if *verbose {
 				log.Printf("Telegram command: %s", cmd.Command)
@@ -306,6 +622,85 @@ func main() {
 	}
 }
 
+func formatLimit(kbps int) string {
+	if kbps == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d KB/s", kbps)
+}
+
+// formatSessions lists sessions for the /status reply. Names and titles come
+// from the media servers and rules, so they are escaped for Markdown.
+func formatSessions(verdicts []SessionVerdict) string {
+	lines := make([]string, 0, len(verdicts))
+	for _, v := range verdicts {
+		status := "not counted"
+		if v.Counted {
+			status = "counted"
+		}
+		detail := v.Reason
+		if v.Decision != "" {
+			detail += ", " + strings.ReplaceAll(v.Decision, "_", " ")
+		}
+		if v.Throttled {
+			detail += ", throttled"
+		}
+		lines = append(lines, fmt.Sprintf("• %s on %s: %s (%s: %s)",
+			escapeMarkdown(v.User), escapeMarkdown(v.Player), escapeMarkdown(v.Title), status, escapeMarkdown(detail)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// countedSessions returns the sessions that count towards streaming.
+func countedSessions(verdicts []SessionVerdict) []SessionVerdict {
+	var counted []SessionVerdict
+	for _, v := range verdicts {
+		if v.Counted {
+			counted = append(counted, v)
+		}
+	}
+	return counted
+}
+
+// formatStreams describes who is playing what, for transition
+// notifications.
+func formatStreams(verdicts []SessionVerdict) string {
+	lines := make([]string, 0, len(verdicts))
+	for _, v := range verdicts {
+		var details []string
+		if v.Quality != "" {
+			details = append(details, v.Quality)
+		}
+		if v.Decision != "" {
+			details = append(details, strings.ReplaceAll(v.Decision, "_", " "))
+		}
+		if v.Remote {
+			details = append(details, "remote")
+		} else {
+			details = append(details, "local")
+		}
+		if v.Bandwidth > 0 {
+			details = append(details, fmt.Sprintf("%.1f Mbps", float64(v.Bandwidth)*8/1000))
+		}
+		lines = append(lines, fmt.Sprintf("• %s: %s on %s (%s)", v.User, v.Title, v.Player, strings.Join(details, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// posterFor returns a loader for the poster of the first session that has
+// one on a server that can serve it, or nil if none does. It runs when the
+// notification is sent so the main loop doesn't wait on it.
+func posterFor(sources *MediaSources, verdicts []SessionVerdict) func() ([]byte, error) {
+	for _, v := range verdicts {
+		if s := v.Session; s.Thumb != "" && sources.ServesPosters(s.Server) {
+			return func() ([]byte, error) {
+				return sources.Poster(s.Server, s.Thumb)
+			}
+		}
+	}
+	return nil
+}
+
 func formatDuration(d time.Duration) string {
 	d = d.Round(time.Second)
 	h := d / time.Hour
@@ -322,3 +717,14 @@ func formatDuration(d time.Duration) string {
 	}
 	return fmt.Sprintf("%ds", s)
 }
+
+// redactURLError drops the URL from the error of a failed request, for
+// requests whose URL carries a secret such as an API key, a bot token or a
+// webhook token.
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
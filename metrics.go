@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal Prometheus text exposition implementation, enough for the
+// handful of metrics plex-helper exports without pulling in client_golang.
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type CounterVec struct {
+	metricName string
+	help       string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{metricName: name, help: help, labels: labels, values: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] += v
+}
+
+func (c *CounterVec) name() string { return c.metricName }
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.metricName, c.help, c.metricName)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.metricName)
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, formatLabels(c.labels, key, "", ""), formatFloat(c.values[key]))
+	}
+}
+
+type GaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is computed at scrape time.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&GaugeFunc{metricName: name, help: help, fn: fn})
+}
+
+func (g *GaugeFunc) name() string { return g.metricName }
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.metricName, g.help, g.metricName, g.metricName, formatFloat(g.fn()))
+}
+
+type HistogramVec struct {
+	metricName string
+	help       string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var defaultLatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{metricName: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// ObserveSince records the time elapsed since start in seconds.
+func (h *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) name() string { return h.metricName }
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.metricName, h.help, h.metricName)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, key, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, formatLabels(h.labels, key, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, formatLabels(h.labels, key, "", ""), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	var pairs []string
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, n := range names {
+			v := ""
+			if i < len(values) {
+				v = values[i]
+			}
+			pairs = append(pairs, fmt.Sprintf("%s=%s", n, strconv.Quote(v)))
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extraName, strconv.Quote(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	metrics = NewRegistry()
+
+	webhooksReceived = metrics.NewCounterVec("plexhelper_webhooks_received_total",
+		"Webhooks received from media servers, by event type.", "event")
+	webhooksRejected = metrics.NewCounterVec("plexhelper_webhooks_rejected_total",
+		"Webhooks rejected by source or token checks, by reason.", "reason")
+	requestErrors = metrics.NewCounterVec("plexhelper_request_errors_total",
+		"Failed requests to Plex and download clients, by service.", "service")
+	requestDuration = metrics.NewHistogramVec("plexhelper_request_duration_seconds",
+		"Latency of requests to Plex and download clients, by service.", defaultLatencyBuckets, "service")
+	stateTransitions = metrics.NewCounterVec("plexhelper_state_transitions_total",
+		"State machine transitions, by source and target state.", "from", "to")
+	telegramSendFailures = metrics.NewCounterVec("plexhelper_telegram_send_failures_total",
+		"Telegram messages that could not be sent.")
+)
+
+// observeRequest records the latency and outcome of a request to service.
+func observeRequest(service string, start time.Time, err error) {
+	requestDuration.ObserveSince(start, service)
+	if err != nil {
+		requestErrors.Inc(service)
+	}
+}
+
+// registerStateMetrics exports the current state machine values as gauges.
+func registerStateMetrics(appState *AppState, manualThrottle *ManualThrottle, cooldown *CooldownTracker) {
+	metrics.NewGaugeFunc("plexhelper_state", "Current state (0 = idle, 1 = streaming).", func() float64 {
+		state, _, _, _, _ := appState.Get()
+		if state == StateStreaming {
+			return 1
+		}
+		return 0
+	})
+	metrics.NewGaugeFunc("plexhelper_remote_streams", "Remote streams seen on the last check.", func() float64 {
+		_, _, streams, _, _ := appState.Get()
+		return float64(streams.Remote)
+	})
+	metrics.NewGaugeFunc("plexhelper_local_streams", "Local streams seen on the last check.", func() float64 {
+		_, _, streams, _, _ := appState.Get()
+		return float64(streams.Local)
+	})
+	metrics.NewGaugeFunc("plexhelper_upload_limit_kbps", "Upload limit currently applied in KB/s (0 = unlimited).", func() float64 {
+		_, _, _, limits, _ := appState.Get()
+		return float64(limits.UploadKbps)
+	})
+	metrics.NewGaugeFunc("plexhelper_download_limit_kbps", "Download limit currently applied in KB/s (0 = unlimited).", func() float64 {
+		_, _, _, limits, _ := appState.Get()
+		return float64(limits.DownloadKbps)
+	})
+	metrics.NewGaugeFunc("plexhelper_manual_throttle_active", "Whether a manual throttle is active.", func() float64 {
+		if manualThrottle.IsActive() {
+			return 1
+		}
+		return 0
+	})
+	metrics.NewGaugeFunc("plexhelper_manual_throttle_remaining_seconds", "Time left on the manual throttle.", func() float64 {
+		return manualThrottle.TimeRemaining().Seconds()
+	})
+	metrics.NewGaugeFunc("plexhelper_cooldown_transitions_in_window", "Streaming to idle transitions in the current cooldown window.", func() float64 {
+		return float64(cooldown.TransitionsInWindow())
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WebhookNotifier posts notifications to an HTTP endpoint. The channels it
+// supports only differ in the request they expect, which payload builds
+// from the notification and its rendered text.
+type WebhookNotifier struct {
+	name     string
+	url      string
+	headers  http.Header
+	template *messageTemplate
+	payload  func(n Notification, text string) ([]byte, http.Header)
+	client   *http.Client
+}
+
+func newNotifier(cfg NotifierConfig) (*WebhookNotifier, error) {
+	w := &WebhookNotifier{
+		name:    cfg.Name,
+		url:     cfg.URL,
+		headers: make(http.Header),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+
+	var fallback string
+	switch cfg.Type {
+	case NotifierTypeDiscord:
+		fallback = defaultDiscordTemplate
+		w.payload = func(_ Notification, text string) ([]byte, http.Header) {
+			return jsonPayload(map[string]string{"content": text})
+		}
+	case NotifierTypeSlack:
+		fallback = defaultSlackTemplate
+		w.payload = func(_ Notification, text string) ([]byte, http.Header) {
+			return jsonPayload(map[string]string{"text": text})
+		}
+	case NotifierTypeNtfy:
+		// ntfy takes the message as the body and the rest as headers.
+		if cfg.Token != "" {
+			w.headers.Set("Authorization", "Bearer "+cfg.Token)
+		}
+		w.payload = func(n Notification, text string) ([]byte, http.Header) {
+			header := http.Header{}
+			header.Set("Content-Type", "text/plain")
+			header.Set("Title", n.Title)
+			header.Set("Tags", n.Kind)
+			return []byte(text), header
+		}
+	case NotifierTypeGotify:
+		w.url = strings.TrimSuffix(cfg.URL, "/") + "/message"
+		w.headers.Set("X-Gotify-Key", cfg.Token)
+		w.payload = func(n Notification, text string) ([]byte, http.Header) {
+			return jsonPayload(map[string]interface{}{"title": n.Title, "message": text, "priority": 5})
+		}
+	case NotifierTypeApprise:
+		w.payload = func(n Notification, text string) ([]byte, http.Header) {
+			return jsonPayload(map[string]string{"title": n.Title, "body": text, "type": "info"})
+		}
+	case NotifierTypeJSON:
+		w.payload = func(n Notification, text string) ([]byte, http.Header) {
+			n.Body = text
+			return jsonPayload(n)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown notifier type %q", cfg.Name, cfg.Type)
+	}
+
+	tmpl, err := newMessageTemplate(cfg.Name, cfg.Template, fallback)
+	if err != nil {
+		return nil, err
+	}
+	w.template = tmpl
+	return w, nil
+}
+
+func jsonPayload(v interface{}) ([]byte, http.Header) {
+	// Marshaling plain maps and Notification can't fail.
+	body, _ := json.Marshal(v)
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	return body, header
+}
+
+func (w *WebhookNotifier) Name() string {
+	return w.name
+}
+
+func (w *WebhookNotifier) Notify(n Notification) (err error) {
+	start := time.Now()
+	defer func() { observeRequest(w.name, start, err) }()
+
+	body, header := w.payload(n, w.template.render(n))
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header = header
+	for k, v := range w.headers {
+		req.Header[k] = v
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", redactURLError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	return nil
+}
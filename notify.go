@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// notifierQueueSize is how many notifications can wait for a slow channel
+// before new ones are dropped.
+const notifierQueueSize = 16
+
+// Notification is a plain-text message about something plex-helper did.
+// Each channel renders it with its own template, so Title and Body carry no
+// markup. Sessions are the sessions behind a transition, and Poster, if set,
+// fetches an image of what one of them is playing for channels that can
+// show it.
+type Notification struct {
+	Kind     string                 `json:"kind"`
+	Title    string                 `json:"title"`
+	Body     string                 `json:"body"`
+	Sessions []SessionVerdict       `json:"sessions,omitempty"`
+	Time     time.Time              `json:"time"`
+	Poster   func() ([]byte, error) `json:"-"`
+}
+
+// Notifier delivers notifications to one channel.
+type Notifier interface {
+	Name() string
+	Notify(n Notification) error
+}
+
+const (
+	defaultTelegramTemplate = "*{{.Title}}*\n{{.Body}}"
+	defaultDiscordTemplate  = "**{{.Title}}**\n{{.Body}}"
+	defaultSlackTemplate    = "*{{.Title}}*\n{{.Body}}"
+)
+
+// messageTemplate renders the text of a notification for one channel.
+type messageTemplate struct {
+	tmpl *template.Template
+}
+
+// newMessageTemplate parses text, or fallback if text is empty. Channels
+// that send the title separately fall back to just the body.
+func newMessageTemplate(name, text, fallback string) (*messageTemplate, error) {
+	if text == "" {
+		text = fallback
+	}
+	if text == "" {
+		text = "{{.Body}}"
+	}
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: parsing template: %w", name, err)
+	}
+	return &messageTemplate{tmpl: tmpl}, nil
+}
+
+func (m *messageTemplate) render(n Notification) string {
+	var b strings.Builder
+	if err := m.tmpl.Execute(&b, n); err != nil {
+		log.Printf("Warning: failed to render %s template: %v", m.tmpl.Name(), err)
+		return n.Title + "\n" + n.Body
+	}
+	return b.String()
+}
+
+type notifierWorker struct {
+	notifier Notifier
+	events   []string
+	queue    chan Notification
+}
+
+// Notifiers fans notifications out to every channel subscribed to their
+// kind. Each channel has its own queue so a slow one neither delays the
+// others nor the caller.
+type Notifiers struct {
+	workers []*notifierWorker
+	wg      sync.WaitGroup
+}
+
+func NewNotifiers(cfg *Config, telegram *TelegramClient) (*Notifiers, error) {
+	n := &Notifiers{}
+	if telegram != nil {
+		// Telegram chats filter notifications themselves.
+		n.add(telegram, nil)
+	}
+	for _, nc := range cfg.Notifiers {
+		notifier, err := newNotifier(nc)
+		if err != nil {
+			return nil, err
+		}
+		n.add(notifier, nc.Events)
+	}
+	return n, nil
+}
+
+func (n *Notifiers) add(notifier Notifier, events []string) {
+	w := &notifierWorker{
+		notifier: notifier,
+		events:   events,
+		queue:    make(chan Notification, notifierQueueSize),
+	}
+	n.workers = append(n.workers, w)
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for msg := range w.queue {
+			if err := notifier.Notify(msg); err != nil {
+				log.Printf("Error sending %s notification: %v", notifier.Name(), err)
+			}
+		}
+	}()
+}
+
+// Send queues a notification for every channel that wants its kind.
+func (n *Notifiers) Send(msg Notification) {
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
+	for _, w := range n.workers {
+		if len(w.events) > 0 && !slices.Contains(w.events, msg.Kind) {
+			continue
+		}
+		select {
+		case w.queue <- msg:
+		default:
+			log.Printf("Warning: %s notification queue full, dropping %q", w.notifier.Name(), msg.Title)
+		}
+	}
+}
+
+// Close delivers the notifications still queued and stops the workers.
+func (n *Notifiers) Close() {
+	for _, w := range n.workers {
+		close(w.queue)
+	}
+	n.wg.Wait()
+}
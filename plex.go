@@ -2,12 +2,24 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
+// errPlexUnauthorized is returned when Plex rejects the token, which usually
+// means it was revoked and the login subcommand needs to be re-run.
+var errPlexUnauthorized = errors.New("invalid plex token (401)")
+
+// maxPosterBytes caps the size of a poster fetched for a notification.
+const maxPosterBytes = 5 << 20
+
 type PlexClient struct {
+	name    string
 	baseURL string
 	token   string
 	client  *http.Client
@@ -17,19 +29,86 @@ type plexSessionsResponse struct {
 	MediaContainer struct {
 		Size     int `json:"size"`
 		Metadata []struct {
+			SessionKey       string `json:"sessionKey"`
+			RatingKey        string `json:"ratingKey"`
+			Type             string `json:"type"`
+			Title            string `json:"title"`
+			GrandparentTitle string `json:"grandparentTitle"`
+			ParentIndex      int    `json:"parentIndex"`
+			Index            int    `json:"index"`
+			Thumb            string `json:"thumb"`
+			GrandparentThumb string `json:"grandparentThumb"`
+			User             struct {
+				Title string `json:"title"`
+			} `json:"User"`
 			Player struct {
-				Local bool   `json:"local"`
-				State string `json:"state"`
+				MachineIdentifier string `json:"machineIdentifier"`
+				Title             string `json:"title"`
+				Product           string `json:"product"`
+				Address           string `json:"address"`
+				Local             bool   `json:"local"`
+				State             string `json:"state"`
 			} `json:"Player"`
 			Session struct {
-				Location string `json:"location"`
+				Location  string `json:"location"`
+				Bandwidth int    `json:"bandwidth"`
 			} `json:"Session"`
+			Media []struct {
+				Bitrate         int    `json:"bitrate"`
+				VideoResolution string `json:"videoResolution"`
+			} `json:"Media"`
+			TranscodeSession *struct {
+				VideoDecision string  `json:"videoDecision"`
+				Throttled     bool    `json:"throttled"`
+				Speed         float64 `json:"speed"`
+			} `json:"TranscodeSession"`
 		} `json:"Metadata"`
 	} `json:"MediaContainer"`
 }
 
-func NewPlexClient(baseURL, token string) *PlexClient {
+// Playback decisions, as derived from a Plex TranscodeSession or a
+// Jellyfin/Emby PlayMethod.
+const (
+	DecisionDirectPlay   = "direct_play"
+	DecisionDirectStream = "direct_stream"
+	DecisionTranscode    = "transcode"
+)
+
+// Session is a single playback session as reported by a media server.
+// BandwidthKbps is converted to KB/s so it can be compared directly with the
+// upload limits in Config. Decision is empty for sessions only known from
+// a webhook; Throttled and Speed are only set for transcodes. Quality is the
+// source video resolution and Thumb the path of a poster on the server, if
+// known. PausedFor and PausedTotal are filled in by SessionTable.
+type Session struct {
+	Server        string
+	Key           string
+	PlayerID      string
+	RatingKey     string
+	Title         string
+	User          string
+	Player        string
+	Product       string
+	Address       string
+	Remote        bool
+	State         string
+	BandwidthKbps int
+	Decision      string
+	Throttled     bool
+	Speed         float64
+	Quality       string
+	Thumb         string
+	PausedFor     time.Duration
+	PausedTotal   time.Duration
+}
+
+func (s Session) IsActive() bool {
+	return s.State == "playing" || s.State == "buffering"
+}
+
+func NewPlexClient(name, baseURL, token string) *PlexClient {
 	return &PlexClient{
+		name:    name,
 		baseURL: baseURL,
 		token:   token,
 		client: &http.Client{
@@ -38,10 +117,102 @@ func NewPlexClient(baseURL, token string) *PlexClient {
 	}
 }
 
-func (p *PlexClient) GetRemoteStreamCount() (int, error) {
-	req, err := http.NewRequest("GET", p.baseURL+"/status/sessions", nil)
+func (p *PlexClient) Name() string {
+	return p.name
+}
+
+func (p *PlexClient) Type() string {
+	return SourceTypePlex
+}
+
+func (p *PlexClient) GetSessions() ([]Session, error) {
+	start := time.Now()
+	sessions, err := p.fetchSessions()
+	observeRequest(p.name, start, err)
+	return sessions, err
+}
+
+// Identity returns the server's machine identifier, which webhooks carry as
+// Server.uuid.
+func (p *PlexClient) Identity() (id string, err error) {
+	start := time.Now()
+	defer func() { observeRequest(p.name, start, err) }()
+
+	body, err := p.get("/identity")
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	var identity struct {
+		MediaContainer struct {
+			MachineIdentifier string `json:"machineIdentifier"`
+		} `json:"MediaContainer"`
+	}
+	if err := json.NewDecoder(body).Decode(&identity); err != nil {
+		return "", fmt.Errorf("decoding response: %w", err)
+	}
+	return identity.MediaContainer.MachineIdentifier, nil
+}
+
+func (p *PlexClient) fetchSessions() ([]Session, error) {
+	body, err := p.get("/status/sessions")
 	if err != nil {
-		return 0, fmt.Errorf("creating request: %w", err)
+		return nil, err
+	}
+	defer body.Close()
+
+	var sessions plexSessionsResponse
+	if err := json.NewDecoder(body).Decode(&sessions); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	result := make([]Session, 0, len(sessions.MediaContainer.Metadata))
+	for _, meta := range sessions.MediaContainer.Metadata {
+		bitrate := meta.Session.Bandwidth
+		var quality string
+		if len(meta.Media) > 0 {
+			if bitrate <= 0 {
+				bitrate = meta.Media[0].Bitrate
+			}
+			quality = formatResolution(meta.Media[0].VideoResolution)
+		}
+		session := Session{
+			Server:        p.name,
+			Key:           meta.SessionKey,
+			PlayerID:      meta.Player.MachineIdentifier,
+			RatingKey:     meta.RatingKey,
+			Title:         plexTitle(meta.Type, meta.GrandparentTitle, meta.ParentIndex, meta.Index, meta.Title),
+			User:          meta.User.Title,
+			Player:        meta.Player.Title,
+			Product:       meta.Player.Product,
+			Address:       meta.Player.Address,
+			Remote:        meta.Session.Location == "wan" || !meta.Player.Local,
+			State:         meta.Player.State,
+			BandwidthKbps: (bitrate + 7) / 8,
+			Decision:      DecisionDirectPlay,
+			Quality:       quality,
+			Thumb:         posterThumb(meta.Thumb, meta.GrandparentThumb),
+		}
+		if ts := meta.TranscodeSession; ts != nil {
+			// Without a video transcode the stream is just remuxed.
+			session.Decision = DecisionDirectStream
+			if ts.VideoDecision == "transcode" {
+				session.Decision = DecisionTranscode
+				session.Throttled = ts.Throttled
+				session.Speed = ts.Speed
+			}
+		}
+		result = append(result, session)
+	}
+
+	return result, nil
+}
+
+func (p *PlexClient) get(path string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", p.baseURL+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
 	}
 
 	req.Header.Set("X-Plex-Token", p.token)
@@ -49,30 +220,81 @@ func (p *PlexClient) GetRemoteStreamCount() (int, error) {
 
 	resp, err := p.client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("making request: %w", err)
+		return nil, fmt.Errorf("making request: %w", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusUnauthorized {
-		return 0, fmt.Errorf("invalid plex token (401)")
+		resp.Body.Close()
+		return nil, errPlexUnauthorized
 	}
 	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
 	}
+	return resp.Body, nil
+}
 
-	var sessions plexSessionsResponse
-	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
-		return 0, fmt.Errorf("decoding response: %w", err)
+// Poster returns a poster-sized JPEG of the image at thumb, scaled by
+// Plex's photo transcoder.
+func (p *PlexClient) Poster(thumb string) (poster []byte, err error) {
+	start := time.Now()
+	defer func() { observeRequest(p.name, start, err) }()
+
+	query := url.Values{
+		"url":     {thumb},
+		"width":   {"300"},
+		"height":  {"450"},
+		"minSize": {"1"},
+		"upscale": {"1"},
 	}
+	body, err := p.get("/photo/:/transcode?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
 
-	count := 0
-	for _, meta := range sessions.MediaContainer.Metadata {
-		isRemote := meta.Session.Location == "wan" || !meta.Player.Local
-		isActive := meta.Player.State == "playing" || meta.Player.State == "buffering"
-		if isRemote && isActive {
-			count++
-		}
+	poster, err = io.ReadAll(io.LimitReader(body, maxPosterBytes))
+	if err != nil {
+		return nil, fmt.Errorf("reading poster: %w", err)
 	}
+	return poster, nil
+}
 
-	return count, nil
+// plexTitle is displayTitle with the season and episode number added for
+// episodes.
+func plexTitle(itemType, grandparentTitle string, parentIndex, index int, title string) string {
+	if itemType == "episode" && parentIndex > 0 && index > 0 {
+		title = fmt.Sprintf("S%02dE%02d - %s", parentIndex, index, title)
+	}
+	return displayTitle(grandparentTitle, title)
+}
+
+// posterThumb prefers the show's poster over an episode's still.
+func posterThumb(thumb, grandparentThumb string) string {
+	if grandparentThumb != "" {
+		return grandparentThumb
+	}
+	return thumb
+}
+
+// formatResolution turns Plex's videoResolution ("1080", "4k", "sd") into
+// a label.
+func formatResolution(res string) string {
+	switch {
+	case res == "":
+		return ""
+	case strings.EqualFold(res, "4k"), strings.EqualFold(res, "sd"):
+		return strings.ToUpper(res)
+	case strings.TrimLeft(res, "0123456789") == "":
+		return res + "p"
+	}
+	return res
+}
+
+// displayTitle prefixes an episode or track title with its show or artist.
+func displayTitle(grandparentTitle, title string) string {
+	if grandparentTitle == "" {
+		return title
+	}
+	return grandparentTitle + " - " + title
 }
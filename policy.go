@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// TorrentPolicyManager applies the per-category/tag torrent policies while
+// streaming and remembers each touched torrent's original state so it can be
+// put back afterwards. A nil manager (no policies configured) is a no-op.
+type TorrentPolicyManager struct {
+	mu       sync.Mutex
+	qbt      *QBittorrentClient
+	policies []TorrentPolicy
+	saved    map[string]torrentSnapshot
+}
+
+type torrentSnapshot struct {
+	UpLimit int  `json:"up_limit"`
+	Limited bool `json:"limited"`
+	Paused  bool `json:"paused"`
+}
+
+func NewTorrentPolicyManager(qbt *QBittorrentClient, policies []TorrentPolicy) *TorrentPolicyManager {
+	if len(policies) == 0 {
+		return nil
+	}
+
+	return &TorrentPolicyManager{
+		qbt:      qbt,
+		policies: policies,
+		saved:    make(map[string]torrentSnapshot),
+	}
+}
+
+func (m *TorrentPolicyManager) match(t TorrentInfo) *TorrentPolicy {
+	for i := range m.policies {
+		p := &m.policies[i]
+		if p.Category != "" && p.Category != t.Category {
+			continue
+		}
+		if p.Tag != "" && !t.HasTag(p.Tag) {
+			continue
+		}
+		return p
+	}
+	return nil
+}
+
+// Apply limits or pauses every matching torrent that isn't already under
+// policy control. Torrents already handled by an earlier Apply are skipped,
+// so it is safe to call repeatedly while streaming.
+func (m *TorrentPolicyManager) Apply() error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	torrents, err := m.qbt.GetTorrents()
+	if err != nil {
+		return fmt.Errorf("listing torrents: %w", err)
+	}
+
+	limits := make(map[int][]string)
+	var pause []string
+	limited := 0
+	for _, t := range torrents {
+		if _, ok := m.saved[t.Hash]; ok {
+			continue
+		}
+
+		p := m.match(t)
+		if p == nil {
+			continue
+		}
+
+		switch p.Action {
+		case PolicyActionLimit:
+			limits[p.UploadKbps*1024] = append(limits[p.UploadKbps*1024], t.Hash)
+			m.saved[t.Hash] = torrentSnapshot{UpLimit: t.UpLimit, Limited: true}
+			limited++
+		case PolicyActionPause:
+			if t.IsPaused() {
+				continue
+			}
+			pause = append(pause, t.Hash)
+			m.saved[t.Hash] = torrentSnapshot{Paused: true}
+		}
+	}
+
+	var errs []error
+	for limit, hashes := range limits {
+		if err := m.qbt.SetTorrentUploadLimit(hashes, limit); err != nil {
+			errs = append(errs, fmt.Errorf("limiting %d torrents: %w", len(hashes), err))
+		}
+	}
+	if len(pause) > 0 {
+		if err := m.qbt.PauseTorrents(pause); err != nil {
+			errs = append(errs, fmt.Errorf("pausing %d torrents: %w", len(pause), err))
+		}
+	}
+
+	if limited > 0 || len(pause) > 0 {
+		log.Printf("Torrent policies applied: %d limited, %d paused", limited, len(pause))
+	}
+	return errors.Join(errs...)
+}
+
+// Restore puts every torrent touched by Apply back to its original upload
+// limit and resumes the ones it paused. Torrents that were already paused
+// before streaming started are never touched, so they stay paused.
+func (m *TorrentPolicyManager) Restore() error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.saved) == 0 {
+		return nil
+	}
+
+	limits := make(map[int][]string)
+	var resume []string
+	for hash, snap := range m.saved {
+		if snap.Paused {
+			resume = append(resume, hash)
+		}
+		if snap.Limited {
+			limits[snap.UpLimit] = append(limits[snap.UpLimit], hash)
+		}
+	}
+
+	var errs []error
+	for limit, hashes := range limits {
+		if limit < 0 {
+			limit = 0
+		}
+		if err := m.qbt.SetTorrentUploadLimit(hashes, limit); err != nil {
+			errs = append(errs, fmt.Errorf("restoring limit on %d torrents: %w", len(hashes), err))
+		}
+	}
+
+	if len(resume) > 0 {
+		if err := m.qbt.ResumeTorrents(resume); err != nil {
+			errs = append(errs, fmt.Errorf("resuming %d torrents: %w", len(resume), err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	log.Printf("Torrent policies restored on %d torrents", len(m.saved))
+	m.saved = make(map[string]torrentSnapshot)
+	return nil
+}
+
+// Tracked returns how many torrents are under policy control.
+func (m *TorrentPolicyManager) Tracked() int {
+	if m == nil {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.saved)
+}
+
+// Snapshot returns the original settings of every torrent currently under
+// policy control, for persisting across restarts.
+func (m *TorrentPolicyManager) Snapshot() map[string]torrentSnapshot {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	saved := make(map[string]torrentSnapshot, len(m.saved))
+	for hash, snap := range m.saved {
+		saved[hash] = snap
+	}
+	return saved
+}
+
+// Load replaces the tracked torrents with a previously saved snapshot so a
+// later Restore puts them back even after a restart.
+func (m *TorrentPolicyManager) Load(saved map[string]torrentSnapshot) {
+	if m == nil || len(saved) == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, snap := range saved {
+		m.saved[hash] = snap
+	}
+}
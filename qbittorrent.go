@@ -1,28 +1,34 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type QBittorrentClient struct {
+	name     string
 	baseURL  string
 	username string
 	password string
 	client   *http.Client
 }
 
-func NewQBittorrentClient(baseURL, username, password string) (*QBittorrentClient, error) {
+func NewQBittorrentClient(name, baseURL, username, password string) (*QBittorrentClient, error) {
 	jar, err := cookiejar.New(nil)
 	if err != nil {
 		return nil, fmt.Errorf("creating cookie jar: %w", err)
 	}
 
 	return &QBittorrentClient{
+		name:     name,
 		baseURL:  strings.TrimSuffix(baseURL, "/"),
 		username: username,
 		password: password,
@@ -33,7 +39,17 @@ func NewQBittorrentClient(baseURL, username, password string) (*QBittorrentClien
 	}, nil
 }
 
+func (q *QBittorrentClient) Name() string {
+	return q.name
+}
+
+// Login authenticates against the WebUI. It is a no-op when no username is
+// configured (e.g. "bypass authentication for clients on localhost").
 func (q *QBittorrentClient) Login() error {
+	if q.username == "" {
+		return nil
+	}
+
 	data := url.Values{}
 	data.Set("username", q.username)
 	data.Set("password", q.password)
@@ -62,68 +78,209 @@ func (q *QBittorrentClient) Login() error {
 	return nil
 }
 
-func (q *QBittorrentClient) SetUploadLimit(bytesPerSec int) error {
-	err := q.setUploadLimitInternal(bytesPerSec)
-	if err != nil && strings.Contains(err.Error(), "403") {
-		if loginErr := q.Login(); loginErr != nil {
-			return fmt.Errorf("re-login failed: %w", loginErr)
+var (
+	errQBittorrentForbidden = errors.New("forbidden (403) - session may have expired")
+	errQBittorrentNotFound  = errors.New("not found (404)")
+)
+
+type TorrentInfo struct {
+	Hash     string `json:"hash"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Tags     string `json:"tags"`
+	UpLimit  int    `json:"up_limit"`
+	State    string `json:"state"`
+}
+
+func (t TorrentInfo) HasTag(tag string) bool {
+	for _, tt := range strings.Split(t.Tags, ",") {
+		if strings.TrimSpace(tt) == tag {
+			return true
 		}
-		return q.setUploadLimitInternal(bytesPerSec)
 	}
+	return false
+}
+
+func (t TorrentInfo) IsPaused() bool {
+	return strings.HasPrefix(t.State, "paused") || strings.HasPrefix(t.State, "stopped")
+}
+
+func (q *QBittorrentClient) SetUploadLimit(bytesPerSec int) error {
+	data := url.Values{}
+	data.Set("limit", fmt.Sprintf("%d", bytesPerSec))
+	_, err := q.do("POST", "/api/v2/transfer/setUploadLimit", data)
 	return err
 }
 
-func (q *QBittorrentClient) setUploadLimitInternal(bytesPerSec int) error {
+func (q *QBittorrentClient) GetUploadLimit() (int, error) {
+	return q.getLimit("/api/v2/transfer/uploadLimit")
+}
+
+func (q *QBittorrentClient) SetDownloadLimit(bytesPerSec int) error {
 	data := url.Values{}
 	data.Set("limit", fmt.Sprintf("%d", bytesPerSec))
+	_, err := q.do("POST", "/api/v2/transfer/setDownloadLimit", data)
+	return err
+}
+
+func (q *QBittorrentClient) GetDownloadLimit() (int, error) {
+	return q.getLimit("/api/v2/transfer/downloadLimit")
+}
 
-	req, err := http.NewRequest("POST", q.baseURL+"/api/v2/transfer/setUploadLimit", strings.NewReader(data.Encode()))
+func (q *QBittorrentClient) getLimit(endpoint string) (int, error) {
+	body, err := q.do("GET", endpoint, nil)
 	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+		return 0, err
 	}
 
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Referer", q.baseURL)
+	limit, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		return 0, fmt.Errorf("parsing limit %q: %w", body, err)
+	}
+	return limit, nil
+}
 
-	resp, err := q.client.Do(req)
+func (q *QBittorrentClient) GetSpeedLimitsMode() (bool, error) {
+	body, err := q.do("GET", "/api/v2/transfer/speedLimitsMode", nil)
 	if err != nil {
-		return fmt.Errorf("making request: %w", err)
+		return false, err
 	}
-	defer resp.Body.Close()
+	return strings.TrimSpace(string(body)) == "1", nil
+}
 
-	if resp.StatusCode == http.StatusForbidden {
-		return fmt.Errorf("forbidden (403) - session may have expired")
+func (q *QBittorrentClient) ToggleSpeedLimitsMode() error {
+	_, err := q.do("POST", "/api/v2/transfer/toggleSpeedLimitsMode", nil)
+	return err
+}
+
+// SetSpeedLimitsMode switches alternative speed limits on or off. The API only
+// offers a toggle, so the current mode is read first and verified afterwards.
+func (q *QBittorrentClient) SetSpeedLimitsMode(enabled bool) error {
+	current, err := q.GetSpeedLimitsMode()
+	if err != nil {
+		return fmt.Errorf("reading speed limits mode: %w", err)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	if current == enabled {
+		return nil
 	}
 
+	if err := q.ToggleSpeedLimitsMode(); err != nil {
+		return fmt.Errorf("toggling speed limits mode: %w", err)
+	}
+
+	current, err = q.GetSpeedLimitsMode()
+	if err != nil {
+		return fmt.Errorf("verifying speed limits mode: %w", err)
+	}
+	if current != enabled {
+		return fmt.Errorf("speed limits mode did not change (alternative=%v)", current)
+	}
 	return nil
 }
 
-func (q *QBittorrentClient) Ping() error {
-	req, err := http.NewRequest("GET", q.baseURL+"/api/v2/app/version", nil)
+func (q *QBittorrentClient) GetTorrents() ([]TorrentInfo, error) {
+	body, err := q.do("GET", "/api/v2/torrents/info", nil)
 	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+		return nil, err
+	}
+
+	var torrents []TorrentInfo
+	if err := json.Unmarshal(body, &torrents); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return torrents, nil
+}
+
+func (q *QBittorrentClient) SetTorrentUploadLimit(hashes []string, bytesPerSec int) error {
+	data := url.Values{}
+	data.Set("hashes", strings.Join(hashes, "|"))
+	data.Set("limit", fmt.Sprintf("%d", bytesPerSec))
+	_, err := q.do("POST", "/api/v2/torrents/setUploadLimit", data)
+	return err
+}
+
+// PauseTorrents pauses the given torrents. qBittorrent 5.0 renamed
+// pause/resume to stop/start, so a 404 falls back to the new endpoint.
+func (q *QBittorrentClient) PauseTorrents(hashes []string) error {
+	data := url.Values{}
+	data.Set("hashes", strings.Join(hashes, "|"))
+	_, err := q.do("POST", "/api/v2/torrents/pause", data)
+	if errors.Is(err, errQBittorrentNotFound) {
+		_, err = q.do("POST", "/api/v2/torrents/stop", data)
+	}
+	return err
+}
+
+func (q *QBittorrentClient) ResumeTorrents(hashes []string) error {
+	data := url.Values{}
+	data.Set("hashes", strings.Join(hashes, "|"))
+	_, err := q.do("POST", "/api/v2/torrents/resume", data)
+	if errors.Is(err, errQBittorrentNotFound) {
+		_, err = q.do("POST", "/api/v2/torrents/start", data)
+	}
+	return err
+}
+
+// do performs an API request, logging in again and retrying once if the
+// session cookie has expired.
+func (q *QBittorrentClient) do(method, endpoint string, data url.Values) ([]byte, error) {
+	body, err := q.doOnce(method, endpoint, data)
+	if errors.Is(err, errQBittorrentForbidden) {
+		if loginErr := q.Login(); loginErr != nil {
+			return nil, fmt.Errorf("re-login failed: %w", loginErr)
+		}
+		return q.doOnce(method, endpoint, data)
+	}
+	return body, err
+}
+
+func (q *QBittorrentClient) doOnce(method, endpoint string, data url.Values) (body []byte, err error) {
+	start := time.Now()
+	defer func() { observeRequest(q.name, start, err) }()
+
+	var req *http.Request
+	if method == "GET" {
+		target := q.baseURL + endpoint
+		if len(data) > 0 {
+			target += "?" + data.Encode()
+		}
+		req, err = http.NewRequest(method, target, nil)
+	} else {
+		req, err = http.NewRequest(method, q.baseURL+endpoint, strings.NewReader(data.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
 	}
 
 	req.Header.Set("Referer", q.baseURL)
 
 	resp, err := q.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("making request: %w", err)
+		return nil, fmt.Errorf("making request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusForbidden {
-		if loginErr := q.Login(); loginErr != nil {
-			return fmt.Errorf("re-login failed: %w", loginErr)
-		}
-		return q.Ping()
+		return nil, errQBittorrentForbidden
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errQBittorrentNotFound
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
 	}
 
-	return nil
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	return body, nil
+}
+
+func (q *QBittorrentClient) Ping() error {
+	_, err := q.do("GET", "/api/v2/app/version", nil)
+	return err
 }
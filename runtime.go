@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// RuntimeState is everything needed to pick up where a previous run left
+// off: the state machine state, the limits last applied, an active manual
+// throttle and the original settings of torrents under policy control.
+type RuntimeState struct {
+	State           string                                `json:"state"`
+	UploadKbps      int                                   `json:"upload_kbps"`
+	DownloadKbps    int                                   `json:"download_kbps"`
+	ManualThrottle  *ManualThrottleState                  `json:"manual_throttle,omitempty"`
+	TorrentPolicies map[string]map[string]torrentSnapshot `json:"torrent_policies,omitempty"`
+	SavedAt         time.Time                             `json:"saved_at"`
+}
+
+type ManualThrottleState struct {
+	ExpiresAt   time.Time `json:"expires_at"`
+	TriggeredBy string    `json:"triggered_by"`
+}
+
+type RuntimeStore struct {
+	path string
+}
+
+func NewRuntimeStore(path string) *RuntimeStore {
+	return &RuntimeStore{path: path}
+}
+
+// Load returns the saved runtime state, or nil if there is none or it can't
+// be read.
+func (r *RuntimeStore) Load() *RuntimeState {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read runtime state: %v", err)
+		}
+		return nil
+	}
+
+	var rs RuntimeState
+	if err := json.Unmarshal(data, &rs); err != nil {
+		log.Printf("Warning: failed to parse runtime state: %v", err)
+		return nil
+	}
+	return &rs
+}
+
+func (r *RuntimeStore) Save(rs *RuntimeState) {
+	rs.SavedAt = time.Now()
+	data, err := json.Marshal(rs)
+	if err != nil {
+		log.Printf("Warning: failed to marshal runtime state: %v", err)
+		return
+	}
+
+	if err := os.WriteFile(r.path, data, 0644); err != nil {
+		log.Printf("Warning: failed to save runtime state: %v", err)
+	}
+}
+
+func parseState(s string) State {
+	if s == StateStreaming.String() {
+		return StateStreaming
+	}
+	return StateIdle
+}
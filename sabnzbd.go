@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SABnzbdClient throttles a SABnzbd instance. Usenet downloads have no
+// upload side, so the upload methods are no-ops and only the download
+// limit is applied.
+type SABnzbdClient struct {
+	name    string
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func NewSABnzbdClient(name, baseURL, apiKey string) *SABnzbdClient {
+	return &SABnzbdClient{
+		name:    name,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (s *SABnzbdClient) Name() string {
+	return s.name
+}
+
+func (s *SABnzbdClient) Login() error {
+	return s.Ping()
+}
+
+func (s *SABnzbdClient) Ping() error {
+	_, err := s.api(url.Values{"mode": {"version"}})
+	return err
+}
+
+func (s *SABnzbdClient) SetUploadLimit(bytesPerSec int) error {
+	return nil
+}
+
+func (s *SABnzbdClient) GetUploadLimit() (int, error) {
+	return 0, errLimitUnsupported
+}
+
+// SetDownloadLimit sets an absolute speed limit. SABnzbd treats bare numbers
+// as a percentage of the configured line speed, so "100" removes the limit.
+func (s *SABnzbdClient) SetDownloadLimit(bytesPerSec int) error {
+	value := "100"
+	if bytesPerSec > 0 {
+		value = fmt.Sprintf("%dK", bytesPerSec/1024)
+	}
+	_, err := s.api(url.Values{"mode": {"config"}, "name": {"speedlimit"}, "value": {value}})
+	return err
+}
+
+func (s *SABnzbdClient) GetDownloadLimit() (int, error) {
+	body, err := s.api(url.Values{"mode": {"queue"}, "limit": {"0"}})
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Queue struct {
+			SpeedLimit    string `json:"speedlimit"`
+			SpeedLimitAbs string `json:"speedlimit_abs"`
+		} `json:"queue"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, fmt.Errorf("decoding response: %w", err)
+	}
+	// With a line speed configured, speedlimit_abs reports it even when
+	// there is no limit. Without one, the percentage is always 100.
+	if result.Queue.SpeedLimit == "0" || result.Queue.SpeedLimit == "100" {
+		lineSpeed, err := s.lineSpeed()
+		if err != nil {
+			return 0, err
+		}
+		if lineSpeed != "" {
+			return 0, nil
+		}
+	}
+	if result.Queue.SpeedLimitAbs == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.ParseFloat(result.Queue.SpeedLimitAbs, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing speed limit %q: %w", result.Queue.SpeedLimitAbs, err)
+	}
+	return int(limit), nil
+}
+
+// lineSpeed returns the configured maximum line speed, which percentage
+// limits are relative to, or "" if none is set.
+func (s *SABnzbdClient) lineSpeed() (string, error) {
+	body, err := s.api(url.Values{"mode": {"get_config"}, "section": {"misc"}, "keyword": {"bandwidth_max"}})
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Config struct {
+			Misc struct {
+				BandwidthMax string `json:"bandwidth_max"`
+			} `json:"misc"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("decoding response: %w", err)
+	}
+	return result.Config.Misc.BandwidthMax, nil
+}
+
+func (s *SABnzbdClient) api(params url.Values) (body json.RawMessage, err error) {
+	start := time.Now()
+	defer func() { observeRequest(s.name, start, err) }()
+
+	params.Set("apikey", s.apiKey)
+	params.Set("output", "json")
+
+	resp, err := s.client.Get(s.baseURL + "/api?" + params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("making request: %w", redactURLError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+		return nil, fmt.Errorf("api error: %s", apiErr.Error)
+	}
+	return body, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	// Embedded so timezone works in images without tzdata (e.g. alpine).
+	_ "time/tzdata"
+)
+
+const defaultProfileName = "default"
+
+// ScheduleProfile overrides some of the base limits during a weekly time
+// range. Days defaults to every day; a range whose end is not after its
+// start runs past midnight into the next day. Limits left unset keep their
+// base value, so 0 has to be given explicitly to mean unlimited.
+type ScheduleProfile struct {
+	Name                  string   `json:"name"`
+	Days                  []string `json:"days"`
+	Start                 string   `json:"start"`
+	End                   string   `json:"end"`
+	IdleUploadKbps        *int     `json:"idle_upload_kbps"`
+	StreamingUploadKbps   *int     `json:"streaming_upload_kbps"`
+	IdleDownloadKbps      *int     `json:"idle_download_kbps"`
+	StreamingDownloadKbps *int     `json:"streaming_download_kbps"`
+}
+
+// Profile is the set of limits in effect at a given time.
+type Profile struct {
+	Name      string
+	Idle      Limits
+	Streaming Limits
+}
+
+type scheduleRule struct {
+	profile Profile
+	days    [7]bool
+	start   int
+	end     int
+}
+
+// Schedule picks the active Profile from the configured schedule. The first
+// matching rule wins; outside all of them the base limits apply.
+type Schedule struct {
+	loc      *time.Location
+	base     Profile
+	profiles []ScheduleProfile
+	rules    []scheduleRule
+}
+
+func NewSchedule(cfg *Config) (*Schedule, error) {
+	loc, err := cfg.location()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Schedule{
+		loc:      loc,
+		profiles: cfg.Schedule,
+		base: Profile{
+			Name:      defaultProfileName,
+			Idle:      Limits{UploadKbps: cfg.IdleUploadKbps, DownloadKbps: cfg.IdleDownloadKbps},
+			Streaming: Limits{UploadKbps: cfg.StreamingUploadKbps, DownloadKbps: cfg.StreamingDownloadKbps},
+		},
+	}
+
+	for i, p := range cfg.Schedule {
+		rule, err := parseScheduleRule(p, s.base)
+		if err != nil {
+			return nil, fmt.Errorf("schedule[%d]: %w", i, err)
+		}
+		s.rules = append(s.rules, rule)
+	}
+	return s, nil
+}
+
+// Enabled reports whether any schedule profiles are configured.
+func (s *Schedule) Enabled() bool {
+	return len(s.rules) > 0
+}
+
+// baseLimitSettings are the config keys of the base limits, which can be
+// changed at runtime with SetBaseLimit.
+var baseLimitSettings = []string{"idle_upload_kbps", "streaming_upload_kbps", "idle_download_kbps", "streaming_download_kbps"}
+
+func (p *Profile) limit(setting string) *int {
+	switch setting {
+	case "idle_upload_kbps":
+		return &p.Idle.UploadKbps
+	case "streaming_upload_kbps":
+		return &p.Streaming.UploadKbps
+	case "idle_download_kbps":
+		return &p.Idle.DownloadKbps
+	case "streaming_download_kbps":
+		return &p.Streaming.DownloadKbps
+	}
+	return nil
+}
+
+// Base returns the limits that apply outside all schedule profiles.
+func (s *Schedule) Base() Profile {
+	return s.base
+}
+
+// SetBaseLimit changes one of the base limits, named by its config key.
+// Schedule profiles that don't override it follow the new value.
+func (s *Schedule) SetBaseLimit(setting string, kbps int) error {
+	if kbps < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	base := s.base
+	dst := base.limit(setting)
+	if dst == nil {
+		return fmt.Errorf("unknown setting %q", setting)
+	}
+	*dst = kbps
+
+	rules := make([]scheduleRule, len(s.profiles))
+	for i, p := range s.profiles {
+		rule, err := parseScheduleRule(p, base)
+		if err != nil {
+			return fmt.Errorf("schedule[%d]: %w", i, err)
+		}
+		rules[i] = rule
+	}
+	s.base = base
+	s.rules = rules
+	return nil
+}
+
+func (s *Schedule) Current() Profile {
+	return s.At(time.Now())
+}
+
+func (s *Schedule) At(t time.Time) Profile {
+	t = t.In(s.loc)
+	minute := t.Hour()*60 + t.Minute()
+	today := int(t.Weekday())
+	yesterday := (today + 6) % 7
+
+	for _, r := range s.rules {
+		if r.start < r.end {
+			if r.days[today] && minute >= r.start && minute < r.end {
+				return r.profile
+			}
+			continue
+		}
+		if (r.days[today] && minute >= r.start) || (r.days[yesterday] && minute < r.end) {
+			return r.profile
+		}
+	}
+	return s.base
+}
+
+func parseScheduleRule(p ScheduleProfile, base Profile) (scheduleRule, error) {
+	if p.Name == "" {
+		return scheduleRule{}, fmt.Errorf("name is required")
+	}
+
+	r := scheduleRule{profile: base}
+	r.profile.Name = p.Name
+	overrides := []struct {
+		value *int
+		dst   *int
+	}{
+		{p.IdleUploadKbps, &r.profile.Idle.UploadKbps},
+		{p.IdleDownloadKbps, &r.profile.Idle.DownloadKbps},
+		{p.StreamingUploadKbps, &r.profile.Streaming.UploadKbps},
+		{p.StreamingDownloadKbps, &r.profile.Streaming.DownloadKbps},
+	}
+	for _, o := range overrides {
+		if o.value == nil {
+			continue
+		}
+		if *o.value < 0 {
+			return scheduleRule{}, fmt.Errorf("limits must not be negative")
+		}
+		*o.dst = *o.value
+	}
+
+	var err error
+	if r.start, err = parseClock(p.Start); err != nil {
+		return scheduleRule{}, fmt.Errorf("start: %w", err)
+	}
+	if r.end, err = parseClock(p.End); err != nil {
+		return scheduleRule{}, fmt.Errorf("end: %w", err)
+	}
+
+	if len(p.Days) == 0 {
+		for d := range r.days {
+			r.days[d] = true
+		}
+	}
+	for _, day := range p.Days {
+		days, ok := weekdayNames[strings.ToLower(day)]
+		if !ok {
+			return scheduleRule{}, fmt.Errorf("unknown day %q", day)
+		}
+		for _, d := range days {
+			r.days[d] = true
+		}
+	}
+	return r, nil
+}
+
+var weekdayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+}
+
+// parseClock parses "HH:MM" into minutes since midnight. An empty string is
+// midnight.
+func parseClock(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (expected HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
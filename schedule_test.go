@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleAt(t *testing.T) {
+	night := 100
+	weekend := 200
+	cfg := &Config{
+		Timezone:            "UTC",
+		StreamingUploadKbps: 500,
+		Schedule: []ScheduleProfile{
+			// Crosses midnight, so Friday night runs into Saturday morning
+			// even though Saturday isn't listed.
+			{Name: "night", Days: []string{"weekdays"}, Start: "22:00", End: "06:00", StreamingUploadKbps: &night},
+			// No start or end covers the whole day.
+			{Name: "weekend", Days: []string{"weekends"}, StreamingUploadKbps: &weekend},
+		},
+	}
+	s, err := NewSchedule(cfg)
+	if err != nil {
+		t.Fatalf("NewSchedule: %v", err)
+	}
+
+	// 2024-01-05 is a Friday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		t    time.Time
+		want string
+	}{
+		{"weekday afternoon", at(3, 15, 0), defaultProfileName},
+		{"weekday night", at(3, 23, 0), "night"},
+		{"weekday early morning", at(4, 5, 59), "night"},
+		{"end is exclusive", at(4, 6, 0), defaultProfileName},
+		{"start is inclusive", at(5, 22, 0), "night"},
+		{"last listed day into the next", at(6, 3, 0), "night"},
+		{"whole-day rule after the overnight range", at(6, 6, 0), "weekend"},
+		{"whole-day rule at midnight", at(7, 0, 0), "weekend"},
+		{"whole-day rule late", at(7, 23, 59), "weekend"},
+		{"day after an unlisted day", at(8, 3, 0), defaultProfileName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.At(tt.t); got.Name != tt.want {
+				t.Errorf("At(%s) = %s, want %s", tt.t.Format("Mon 15:04"), got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleProfileInheritsBase(t *testing.T) {
+	night := 100
+	cfg := &Config{
+		Timezone:              "UTC",
+		IdleUploadKbps:        1000,
+		StreamingUploadKbps:   500,
+		StreamingDownloadKbps: 2000,
+		Schedule: []ScheduleProfile{
+			{Name: "night", Start: "22:00", End: "06:00", StreamingUploadKbps: &night},
+		},
+	}
+	s, err := NewSchedule(cfg)
+	if err != nil {
+		t.Fatalf("NewSchedule: %v", err)
+	}
+
+	p := s.At(time.Date(2024, time.January, 5, 23, 0, 0, 0, time.UTC))
+	want := Profile{
+		Name:      "night",
+		Idle:      Limits{UploadKbps: 1000},
+		Streaming: Limits{UploadKbps: 100, DownloadKbps: 2000},
+	}
+	if p != want {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+}
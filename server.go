@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -14,44 +17,65 @@ type ServiceHealth struct {
 }
 
 type HealthResponse struct {
-	Status                 string                   `json:"status"`
-	State                  string                   `json:"state"`
-	UptimeSec              int64                    `json:"uptime_sec"`
-	LastCheck              string                   `json:"last_check,omitempty"`
-	RemoteStreams          int                      `json:"remote_streams"`
-	CurrentUploadLimitKbps int                      `json:"current_upload_limit_kbps"`
-	ManualThrottle         bool                     `json:"manual_throttle"`
-	ManualThrottleExpires  string                   `json:"manual_throttle_expires,omitempty"`
-	Services               map[string]ServiceHealth `json:"services"`
+	Status                   string                   `json:"status"`
+	State                    string                   `json:"state"`
+	UptimeSec                int64                    `json:"uptime_sec"`
+	LastCheck                string                   `json:"last_check,omitempty"`
+	RemoteStreams            int                      `json:"remote_streams"`
+	Streams                  StreamCounts             `json:"streams"`
+	CurrentUploadLimitKbps   int                      `json:"current_upload_limit_kbps"`
+	CurrentDownloadLimitKbps int                      `json:"current_download_limit_kbps"`
+	ManualThrottle           bool                     `json:"manual_throttle"`
+	ManualThrottleExpires    string                   `json:"manual_throttle_expires,omitempty"`
+	Hysteresis               HysteresisStatus         `json:"hysteresis"`
+	DriftCorrections         int                      `json:"drift_corrections"`
+	Profile                  string                   `json:"profile"`
+	Sessions                 []SessionVerdict         `json:"sessions"`
+	Services                 map[string]ServiceHealth `json:"services"`
 }
 
 type Server struct {
 	port           int
 	state          *AppState
-	plex           *PlexClient
-	qbt            *QBittorrentClient
-	eventCh        chan<- string
+	sources        *MediaSources
+	throttlers     *ThrottleGroup
+	eventCh        chan<- WebhookEvent
 	manualThrottle *ManualThrottle
+	telegram       *TelegramClient
+	webhookToken   string
+	webhookNets    []*net.IPNet
 }
 
-func NewServer(port int, state *AppState, plex *PlexClient, qbt *QBittorrentClient, eventCh chan<- string, manualThrottle *ManualThrottle) *Server {
+func NewServer(port int, state *AppState, sources *MediaSources, throttlers *ThrottleGroup, eventCh chan<- WebhookEvent, manualThrottle *ManualThrottle, telegram *TelegramClient, webhookToken string, webhookNets []*net.IPNet) *Server {
 	return &Server{
 		port:           port,
 		state:          state,
-		plex:           plex,
-		qbt:            qbt,
+		sources:        sources,
+		throttlers:     throttlers,
 		eventCh:        eventCh,
 		manualThrottle: manualThrottle,
+		telegram:       telegram,
+		webhookToken:   webhookToken,
+		webhookNets:    webhookNets,
 	}
 }
 
 func (s *Server) Start() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", s.handleHealth)
-	mux.HandleFunc("/webhook", s.handleWebhook)
+	mux.HandleFunc("/webhook", s.requireWebhookAuth(s.handleWebhook))
+	mux.HandleFunc("/webhook/", s.requireWebhookAuth(s.handleWebhook))
+	mux.HandleFunc("/webhook/jellyfin", s.requireWebhookAuth(s.handleJellyfinWebhook))
+	mux.HandleFunc("/webhook/jellyfin/", s.requireWebhookAuth(s.handleJellyfinWebhook))
+	mux.HandleFunc("/webhook/emby", s.requireWebhookAuth(s.handleEmbyWebhook))
+	mux.HandleFunc("/webhook/emby/", s.requireWebhookAuth(s.handleEmbyWebhook))
+	mux.HandleFunc("/webhook/tautulli", s.requireWebhookAuth(s.handleTautulliWebhook))
+	mux.HandleFunc("/webhook/tautulli/", s.requireWebhookAuth(s.handleTautulliWebhook))
+	mux.HandleFunc("/telegram", s.handleTelegram)
+	mux.HandleFunc("/metrics", s.handleMetrics)
 
 	addr := fmt.Sprintf(":%d", s.port)
-	log.Printf("Starting server on %s (health + webhook)", addr)
+	log.Printf("Starting server on %s (health + webhook + metrics)", addr)
 
 	go func() {
 		if err := http.ListenAndServe(addr, mux); err != nil {
@@ -61,29 +85,39 @@ func (s *Server) Start() {
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	state, lastCheck, remoteStreams, uploadLimit, startTime := s.state.Get()
+	state, lastCheck, streams, limits, startTime := s.state.Get()
 
 	services := make(map[string]ServiceHealth)
 
-	plexStart := time.Now()
-	_, plexErr := s.plex.GetRemoteStreamCount()
-	plexLatency := time.Since(plexStart).Milliseconds()
-	services["plex"] = ServiceHealth{
-		Reachable: plexErr == nil,
-		LatencyMs: plexLatency,
+	var sourceErr error
+	for _, src := range s.sources.Sources() {
+		start := time.Now()
+		_, err := src.GetSessions()
+		services[src.Name()] = ServiceHealth{
+			Reachable: err == nil,
+			LatencyMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			sourceErr = err
+		}
 	}
 
-	qbtStart := time.Now()
-	qbtErr := s.qbt.Ping()
-	qbtLatency := time.Since(qbtStart).Milliseconds()
-	services["qbittorrent"] = ServiceHealth{
-		Reachable: qbtErr == nil,
-		LatencyMs: qbtLatency,
+	var throttlerErr error
+	for _, t := range s.throttlers.Throttlers() {
+		start := time.Now()
+		err := t.Ping()
+		services[t.Name()] = ServiceHealth{
+			Reachable: err == nil,
+			LatencyMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			throttlerErr = err
+		}
 	}
 
 	status := "healthy"
 	statusCode := http.StatusOK
-	if plexErr != nil || qbtErr != nil {
+	if sourceErr != nil || throttlerErr != nil {
 		status = "degraded"
 		statusCode = http.StatusServiceUnavailable
 	}
@@ -105,15 +139,21 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := HealthResponse{
-		Status:                 status,
-		State:                  stateStr,
-		UptimeSec:              int64(time.Since(startTime).Seconds()),
-		LastCheck:              lastCheckStr,
-		RemoteStreams:          remoteStreams,
-		CurrentUploadLimitKbps: uploadLimit,
-		ManualThrottle:         manualActive,
-		ManualThrottleExpires:  manualExpiresStr,
-		Services:               services,
+		Status:                   status,
+		State:                    stateStr,
+		UptimeSec:                int64(time.Since(startTime).Seconds()),
+		LastCheck:                lastCheckStr,
+		RemoteStreams:            streams.Remote,
+		Streams:                  streams,
+		CurrentUploadLimitKbps:   limits.UploadKbps,
+		CurrentDownloadLimitKbps: limits.DownloadKbps,
+		ManualThrottle:           manualActive,
+		ManualThrottleExpires:    manualExpiresStr,
+		Hysteresis:               s.state.GetHysteresis(),
+		DriftCorrections:         s.state.DriftCorrections(),
+		Profile:                  s.state.Profile(),
+		Sessions:                 s.state.Sessions(),
+		Services:                 services,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -121,11 +161,99 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Write(w)
+}
+
+// requireWebhookAuth rejects webhooks from outside webhook_allowed_cidrs
+// (403) or without the configured token (401). The token can be passed as
+// ?token=... or as the last path segment, e.g. /webhook/<token>, since Plex
+// only lets you configure a URL.
+func (s *Server) requireWebhookAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		if len(s.webhookNets) > 0 && !ipAllowed(net.ParseIP(host), s.webhookNets) {
+			log.Printf("Warning: rejected webhook from %s: source not allowed", host)
+			webhooksRejected.Inc("source")
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if s.webhookToken != "" {
+			token := r.URL.Query().Get("token")
+			if token == "" {
+				token = r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.webhookToken)) != 1 {
+				log.Printf("Warning: rejected webhook from %s: invalid token", host)
+				webhooksRejected.Inc("token")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+func ipAllowed(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 type plexWebhookPayload struct {
-	Event  string `json:"event"`
+	Event   string `json:"event"`
+	Account struct {
+		Title string `json:"title"`
+	} `json:"Account"`
+	Server struct {
+		UUID  string `json:"uuid"`
+		Title string `json:"title"`
+	} `json:"Server"`
 	Player struct {
-		Local bool `json:"local"`
+		Local         bool   `json:"local"`
+		PublicAddress string `json:"publicAddress"`
+		Title         string `json:"title"`
+		UUID          string `json:"uuid"`
 	} `json:"Player"`
+	Metadata struct {
+		RatingKey        string `json:"ratingKey"`
+		Type             string `json:"type"`
+		Title            string `json:"title"`
+		GrandparentTitle string `json:"grandparentTitle"`
+		ParentIndex      int    `json:"parentIndex"`
+		Index            int    `json:"index"`
+		Thumb            string `json:"thumb"`
+		GrandparentThumb string `json:"grandparentThumb"`
+	} `json:"Metadata"`
+}
+
+func (p plexWebhookPayload) toEvent() WebhookEvent {
+	return WebhookEvent{
+		Event:         p.Event,
+		SourceType:    SourceTypePlex,
+		Account:       p.Account.Title,
+		ServerUUID:    p.Server.UUID,
+		PlayerID:      p.Player.UUID,
+		PlayerTitle:   p.Player.Title,
+		PlayerAddress: p.Player.PublicAddress,
+		Local:         p.Player.Local,
+		RatingKey:     p.Metadata.RatingKey,
+		Title:         plexTitle(p.Metadata.Type, p.Metadata.GrandparentTitle, p.Metadata.ParentIndex, p.Metadata.Index, p.Metadata.Title),
+		Thumb:         posterThumb(p.Metadata.Thumb, p.Metadata.GrandparentThumb),
+	}
 }
 
 func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
@@ -151,14 +279,52 @@ func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch webhook.Event {
-	case "media.play", "media.resume", "media.stop", "media.pause":
-		log.Printf("Webhook: %s (local=%v)", webhook.Event, webhook.Player.Local)
-		select {
-		case s.eventCh <- webhook.Event:
-		default:
-		}
+	webhooksReceived.Inc(webhook.Event)
+
+	s.queueEvent(webhook.toEvent())
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleTelegram receives Telegram updates while the bot is in webhook mode.
+// Telegram echoes the secret the webhook was registered with in a header.
+func (s *Server) handleTelegram(w http.ResponseWriter, r *http.Request) {
+	if !s.telegram.WebhookActive() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.telegram.ValidWebhookSecret(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		log.Printf("Warning: rejected Telegram update from %s: invalid secret", host)
+		webhooksRejected.Inc("telegram_secret")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var update TelegramUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
 	}
 
+	s.telegram.HandleUpdate(update)
 	w.WriteHeader(http.StatusOK)
 }
+
+// queueEvent hands a playback event to the main loop without blocking the
+// webhook sender. Events are logged there, once they are known to change
+// something, since Jellyfin sends progress updates every few seconds.
+func (s *Server) queueEvent(event WebhookEvent) {
+	if !event.IsPlayback() {
+		return
+	}
+
+	select {
+	case s.eventCh <- event:
+	default:
+		log.Printf("Warning: event queue full, dropping %s webhook", event.Event)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// SessionVerdict records whether a session counts towards streaming and why,
+// so /health and /status can explain the current state.
+type SessionVerdict struct {
+	Session    Session `json:"-"`
+	User       string  `json:"user"`
+	Player     string  `json:"player"`
+	Title      string  `json:"title"`
+	State      string  `json:"state"`
+	Remote     bool    `json:"remote"`
+	Decision   string  `json:"decision,omitempty"`
+	Throttled  bool    `json:"throttled,omitempty"`
+	Speed      float64 `json:"speed,omitempty"`
+	Quality    string  `json:"quality,omitempty"`
+	Bandwidth  int     `json:"bandwidth_kbps,omitempty"`
+	Counted    bool    `json:"counted"`
+	Weight     float64 `json:"weight"`
+	UploadKbps int     `json:"upload_kbps,omitempty"`
+	Reason     string  `json:"reason"`
+}
+
+type sessionRule struct {
+	SessionRule
+	net *net.IPNet
+}
+
+// SessionRules decides how each Plex session counts towards streaming.
+type SessionRules struct {
+	rules           []sessionRule
+	pauseGrace      time.Duration
+	maxPause        time.Duration
+	localProtection bool
+}
+
+func NewSessionRules(cfg *Config) (*SessionRules, error) {
+	r := &SessionRules{
+		pauseGrace:      time.Duration(cfg.PauseGraceSec) * time.Second,
+		maxPause:        time.Duration(cfg.MaxPauseSec) * time.Second,
+		localProtection: cfg.LocalProtection,
+	}
+	for i, rule := range cfg.SessionRules {
+		if rule.User == "" && rule.Product == "" && rule.Player == "" && rule.Address == "" {
+			return nil, fmt.Errorf("session_rules[%d]: user, product, player or address is required", i)
+		}
+		switch rule.Action {
+		case SessionActionIgnore:
+		case SessionActionWeight:
+			if rule.Weight <= 0 {
+				return nil, fmt.Errorf("session_rules[%d]: weight must be positive for action %q", i, SessionActionWeight)
+			}
+		case SessionActionLimit:
+			if rule.UploadKbps <= 0 {
+				return nil, fmt.Errorf("session_rules[%d]: upload_kbps must be positive for action %q", i, SessionActionLimit)
+			}
+		default:
+			return nil, fmt.Errorf("session_rules[%d]: unknown action %q", i, rule.Action)
+		}
+
+		sr := sessionRule{SessionRule: rule}
+		if rule.Address != "" {
+			n, err := parseNet(rule.Address)
+			if err != nil {
+				return nil, fmt.Errorf("session_rules[%d]: %w", i, err)
+			}
+			sr.net = n
+		}
+		if sr.Name == "" {
+			sr.Name = sr.describe()
+		}
+		r.rules = append(r.rules, sr)
+	}
+	return r, nil
+}
+
+func (r sessionRule) matches(s Session) bool {
+	if r.User != "" && !strings.EqualFold(r.User, s.User) {
+		return false
+	}
+	if r.Product != "" && !strings.EqualFold(r.Product, s.Product) {
+		return false
+	}
+	if r.Player != "" && !strings.EqualFold(r.Player, s.Player) {
+		return false
+	}
+	if r.net != nil {
+		ip := net.ParseIP(s.Address)
+		if ip == nil || !r.net.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r sessionRule) describe() string {
+	var parts []string
+	for _, f := range []struct{ key, value string }{
+		{"user", r.User},
+		{"product", r.Product},
+		{"player", r.Player},
+		{"address", r.Address},
+	} {
+		if f.value != "" {
+			parts = append(parts, fmt.Sprintf("%s=%s", f.key, f.value))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Evaluate returns a verdict for every session. Only active remote sessions
+// (and local ones with local_protection), or such sessions still within
+// their pause grace, are counted; rules can then ignore, weight or limit
+// them.
+func (r *SessionRules) Evaluate(sessions []Session) []SessionVerdict {
+	verdicts := make([]SessionVerdict, 0, len(sessions))
+	for _, s := range sessions {
+		v := SessionVerdict{
+			Session:   s,
+			User:      s.User,
+			Player:    s.Player,
+			Title:     s.Title,
+			State:     s.State,
+			Remote:    s.Remote,
+			Decision:  s.Decision,
+			Throttled: s.Throttled,
+			Speed:     s.Speed,
+			Quality:   s.Quality,
+			Bandwidth: s.BandwidthKbps,
+		}
+
+		location := "remote"
+		if !s.Remote {
+			location = "local"
+		}
+
+		switch {
+		case !s.Remote && !r.localProtection:
+			v.Reason = location
+		case s.IsActive():
+			v.Counted = true
+			v.Weight = 1
+			v.Reason = location
+			r.apply(&v)
+		case s.State == "paused" && r.inPauseGrace(s):
+			v.Counted = true
+			v.Weight = 1
+			v.Reason = fmt.Sprintf("%s, paused for %s, within grace", location, formatDuration(s.PausedFor))
+			r.apply(&v)
+		case s.State == "paused" && r.pauseGrace > 0:
+			v.Reason = fmt.Sprintf("%s, paused for %s, grace expired", location, formatDuration(s.PausedFor))
+		default:
+			v.Reason = s.State
+		}
+		verdicts = append(verdicts, v)
+	}
+	return verdicts
+}
+
+// inPauseGrace reports whether a paused session should still count: it has
+// been paused for less than pause_grace_sec and, if max_pause_sec is set,
+// its pauses add up to less than that.
+func (r *SessionRules) inPauseGrace(s Session) bool {
+	if s.PausedFor >= r.pauseGrace {
+		return false
+	}
+	return r.maxPause == 0 || s.PausedTotal < r.maxPause
+}
+
+func (r *SessionRules) apply(v *SessionVerdict) {
+	for _, rule := range r.rules {
+		if !rule.matches(v.Session) {
+			continue
+		}
+		switch rule.Action {
+		case SessionActionIgnore:
+			v.Counted = false
+			v.Weight = 0
+			v.Reason = fmt.Sprintf("ignored by rule %s", rule.Name)
+		case SessionActionWeight:
+			v.Weight = rule.Weight
+			v.Reason = fmt.Sprintf("weight %g by rule %s", rule.Weight, rule.Name)
+		case SessionActionLimit:
+			v.UploadKbps = rule.UploadKbps
+			v.Reason = fmt.Sprintf("limited to %s by rule %s", formatLimit(rule.UploadKbps), rule.Name)
+		}
+		return
+	}
+}
+
+// countedStreams returns the number of counted remote and local sessions
+// and whether each group adds up to streaming. A group is streaming once its
+// total weight reaches 1, so a session weighted 0.5 only counts alongside
+// another one.
+func countedStreams(verdicts []SessionVerdict) (counts StreamCounts, remote, local bool) {
+	var remoteWeight, localWeight float64
+	for _, v := range verdicts {
+		if !v.Counted {
+			continue
+		}
+		if v.Remote {
+			counts.Remote++
+			remoteWeight += v.Weight
+		} else {
+			counts.Local++
+			localWeight += v.Weight
+		}
+	}
+	// Allow for rounding when fractional weights add up to exactly 1.
+	return counts, remoteWeight >= 1-1e-9, localWeight >= 1-1e-9
+}
+
+// sessionLimitKbps returns the lowest upload limit assigned by a limit rule
+// to any counted session, or 0 if there is none.
+func sessionLimitKbps(verdicts []SessionVerdict) int {
+	limit := 0
+	for _, v := range verdicts {
+		if v.Counted {
+			limit = minLimit(limit, v.UploadKbps)
+		}
+	}
+	return limit
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// webhookSessionGrace is how long a session only known from a webhook
+// survives polls that don't report it, to cover the delay before Plex lists
+// a new session in /status/sessions.
+const webhookSessionGrace = 30 * time.Second
+
+// WebhookEvent is the part of a webhook payload plex-helper acts on.
+// Jellyfin, Emby and Tautulli events are translated to the equivalent Plex
+// event names. Server is the name of the configured server it came from,
+// resolved from SourceType and ServerUUID. BandwidthKbps is only known for
+// Tautulli events and Thumb for Plex ones.
+type WebhookEvent struct {
+	Event         string
+	SourceType    string
+	Server        string
+	Account       string
+	ServerUUID    string
+	PlayerID      string
+	PlayerTitle   string
+	PlayerAddress string
+	Local         bool
+	RatingKey     string
+	Title         string
+	BandwidthKbps int
+	Thumb         string
+}
+
+// IsPlayback reports whether the event changes the state of a playback
+// session.
+func (e WebhookEvent) IsPlayback() bool {
+	switch e.Event {
+	case "media.play", "media.resume", "media.pause", "media.stop":
+		return true
+	}
+	return false
+}
+
+// SessionTable tracks playback sessions keyed by server, player and item.
+// Webhooks update it as they arrive, and every Plex poll replaces a server's
+// sessions with what it actually reports, so a missed or spoofed webhook is
+// corrected on the next poll.
+type SessionTable struct {
+	mu      sync.Mutex
+	entries map[string]*trackedSession
+}
+
+type trackedSession struct {
+	session     Session
+	webhookOnly bool
+	updated     time.Time
+	pausedSince time.Time
+	pausedTotal time.Duration
+}
+
+// setState records a state change, keeping track of how long the session
+// has been paused for, now and in total.
+func (e *trackedSession) setState(state string, now time.Time) {
+	paused := !e.pausedSince.IsZero()
+	switch {
+	case state == "paused" && !paused:
+		e.pausedSince = now
+	case state != "paused" && paused:
+		e.pausedTotal += now.Sub(e.pausedSince)
+		e.pausedSince = time.Time{}
+	}
+	e.session.State = state
+}
+
+func NewSessionTable() *SessionTable {
+	return &SessionTable{entries: make(map[string]*trackedSession)}
+}
+
+func sessionKey(server, playerID, ratingKey string) string {
+	return server + "/" + playerID + "/" + ratingKey
+}
+
+// ApplyWebhook updates the table from a playback webhook and reports whether
+// anything changed.
+func (t *SessionTable) ApplyWebhook(ev WebhookEvent) bool {
+	if !ev.IsPlayback() || ev.PlayerID == "" {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := sessionKey(ev.Server, ev.PlayerID, ev.RatingKey)
+	entry, ok := t.entries[key]
+
+	if ev.Event == "media.stop" {
+		if !ok {
+			return false
+		}
+		delete(t.entries, key)
+		return true
+	}
+
+	state := "playing"
+	if ev.Event == "media.pause" {
+		state = "paused"
+	}
+
+	now := time.Now()
+	if !ok {
+		entry = &trackedSession{
+			session: Session{
+				Server:        ev.Server,
+				PlayerID:      ev.PlayerID,
+				RatingKey:     ev.RatingKey,
+				Title:         ev.Title,
+				User:          ev.Account,
+				Player:        ev.PlayerTitle,
+				Address:       ev.PlayerAddress,
+				Remote:        !ev.Local,
+				BandwidthKbps: ev.BandwidthKbps,
+				Thumb:         ev.Thumb,
+			},
+			webhookOnly: true,
+			updated:     now,
+		}
+		entry.setState(state, now)
+		t.entries[key] = entry
+		return true
+	}
+
+	entry.updated = now
+	if entry.session.State == state {
+		return false
+	}
+	entry.setState(state, now)
+	return true
+}
+
+// Reconcile replaces a server's sessions with those reported by polling it,
+// carrying over pause tracking for sessions it already knew. Sessions only
+// known from a webhook are kept for webhookSessionGrace so a poll racing a
+// fresh media.play doesn't drop it.
+func (t *SessionTable) Reconcile(server string, polled []Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	entries := make(map[string]*trackedSession, len(t.entries))
+	for _, s := range polled {
+		key := sessionKey(server, s.PlayerID, s.RatingKey)
+		entry := &trackedSession{session: s, updated: now}
+		if old, ok := t.entries[key]; ok {
+			entry.pausedSince = old.pausedSince
+			entry.pausedTotal = old.pausedTotal
+		}
+		entry.setState(s.State, now)
+		entries[key] = entry
+	}
+	for key, entry := range t.entries {
+		if _, ok := entries[key]; ok {
+			continue
+		}
+		if entry.session.Server != server || (entry.webhookOnly && now.Sub(entry.updated) < webhookSessionGrace) {
+			entries[key] = entry
+		}
+	}
+	t.entries = entries
+}
+
+// Sessions returns the tracked sessions ordered by key, with their pause
+// durations filled in.
+func (t *SessionTable) Sessions() []Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]string, 0, len(t.entries))
+	for k := range t.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	sessions := make([]Session, 0, len(keys))
+	for _, k := range keys {
+		entry := t.entries[k]
+		s := entry.session
+		s.PausedTotal = entry.pausedTotal
+		if !entry.pausedSince.IsZero() {
+			s.PausedFor = now.Sub(entry.pausedSince)
+			s.PausedTotal += s.PausedFor
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
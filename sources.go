@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// MediaSource is a media server whose playback sessions plex-helper watches.
+// Sessions are returned in the common Session shape so the state machine
+// doesn't care which server they came from.
+type MediaSource interface {
+	Name() string
+	Type() string
+	// Identity returns the server ID that its webhooks carry.
+	Identity() (string, error)
+	GetSessions() ([]Session, error)
+}
+
+// StreamCounts breaks playing sessions down by where the player is.
+type StreamCounts struct {
+	Local  int `json:"local"`
+	Remote int `json:"remote"`
+}
+
+// MediaSources watches every configured media server. Sessions from all of
+// them feed the same throttle decision since they share the uplink.
+type MediaSources struct {
+	sources []MediaSource
+
+	mu           sync.RWMutex
+	byUUID       map[string]string
+	identified   map[string]bool
+	lastIdentify time.Time
+}
+
+// identifyRetryInterval is how often a webhook from an unknown server ID
+// may retry looking up the servers that couldn't be identified. Plex sends
+// webhooks for every server an account uses, so unknown IDs are common.
+const identifyRetryInterval = time.Minute
+
+// SourcePoll is the result of polling one server. Sessions is only valid if
+// Err is nil.
+type SourcePoll struct {
+	Server   string
+	Sessions []Session
+	Err      error
+}
+
+func NewMediaSources(cfg *Config) (*MediaSources, error) {
+	m := &MediaSources{byUUID: make(map[string]string), identified: make(map[string]bool)}
+	for _, ms := range cfg.MediaServers {
+		var src MediaSource
+		switch ms.Type {
+		case SourceTypePlex:
+			src = NewPlexClient(ms.Name, ms.URL, ms.Token)
+		case SourceTypeJellyfin, SourceTypeEmby:
+			src = NewJellyfinClient(ms.Name, ms.Type, ms.URL, ms.Token)
+		case SourceTypeTautulli:
+			src = NewTautulliClient(ms.Name, ms.URL, ms.Token)
+		default:
+			return nil, fmt.Errorf("%s: unknown media server type %q", ms.Name, ms.Type)
+		}
+		m.sources = append(m.sources, src)
+	}
+	return m, nil
+}
+
+func (m *MediaSources) Sources() []MediaSource {
+	return m.sources
+}
+
+// Identify looks up the ID of each server not identified yet so webhooks
+// can be routed to it. Servers that can't be reached are retried when an
+// unknown ID arrives, at most once per identifyRetryInterval.
+func (m *MediaSources) Identify() {
+	m.mu.Lock()
+	m.lastIdentify = time.Now()
+	m.mu.Unlock()
+
+	for _, src := range m.sources {
+		m.mu.RLock()
+		done := m.identified[src.Name()]
+		m.mu.RUnlock()
+		if done {
+			continue
+		}
+
+		id, err := src.Identity()
+		if err != nil {
+			log.Printf("Warning: failed to get identity of %s: %s", src.Name(), loginHint(err))
+			continue
+		}
+
+		m.mu.Lock()
+		m.byUUID[id] = src.Name()
+		m.identified[src.Name()] = true
+		m.mu.Unlock()
+	}
+}
+
+// ServerFor returns the name of the server of the given type with the given
+// ID. Webhooks without an ID are attributed to the only server of their type
+// if there is just one. Tautulli sources are Plex servers as far as webhooks
+// are concerned.
+func (m *MediaSources) ServerFor(sourceType, uuid string) (string, bool) {
+	if uuid == "" {
+		var match []string
+		for _, src := range m.sources {
+			if webhookType(src) == sourceType {
+				match = append(match, src.Name())
+			}
+		}
+		if len(match) == 1 {
+			return match[0], true
+		}
+		return "", false
+	}
+
+	m.mu.RLock()
+	name, ok := m.byUUID[uuid]
+	retry := time.Since(m.lastIdentify) >= identifyRetryInterval
+	m.mu.RUnlock()
+	if ok || !retry {
+		return name, ok
+	}
+
+	m.Identify()
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	name, ok = m.byUUID[uuid]
+	return name, ok
+}
+
+// posterSource is a MediaSource that can serve poster images.
+type posterSource interface {
+	Poster(thumb string) ([]byte, error)
+}
+
+// ServesPosters reports whether the named server can serve poster images.
+func (m *MediaSources) ServesPosters(server string) bool {
+	for _, src := range m.sources {
+		if src.Name() == server {
+			_, ok := src.(posterSource)
+			return ok
+		}
+	}
+	return false
+}
+
+// Poster fetches the poster at thumb from the named server.
+func (m *MediaSources) Poster(server, thumb string) ([]byte, error) {
+	for _, src := range m.sources {
+		if src.Name() != server {
+			continue
+		}
+		if ps, ok := src.(posterSource); ok {
+			return ps.Poster(thumb)
+		}
+		return nil, fmt.Errorf("%s does not serve posters", server)
+	}
+	return nil, fmt.Errorf("unknown server %q", server)
+}
+
+// Poll fetches the sessions of every server concurrently.
+func (m *MediaSources) Poll() []SourcePoll {
+	polls := make([]SourcePoll, len(m.sources))
+
+	var wg sync.WaitGroup
+	for i, src := range m.sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sessions, err := src.GetSessions()
+			polls[i] = SourcePoll{Server: src.Name(), Sessions: sessions, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	return polls
+}
+
+// webhookType returns the source type of the webhooks a source receives.
+func webhookType(src MediaSource) string {
+	if src.Type() == SourceTypeTautulli {
+		return SourceTypePlex
+	}
+	return src.Type()
+}
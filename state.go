@@ -6,12 +6,16 @@ import (
 )
 
 type AppState struct {
-	mu              sync.RWMutex
-	state           State
-	lastCheckTime   time.Time
-	remoteStreams   int
-	uploadLimitKbps int
-	startTime       time.Time
+	mu               sync.RWMutex
+	state            State
+	lastCheckTime    time.Time
+	streams          StreamCounts
+	limits           Limits
+	startTime        time.Time
+	hysteresis       HysteresisStatus
+	driftCorrections int
+	profile          string
+	sessions         []SessionVerdict
 }
 
 func NewAppState() *AppState {
@@ -21,19 +25,67 @@ func NewAppState() *AppState {
 	}
 }
 
-func (a *AppState) Update(state State, remoteStreams, uploadLimitKbps int) {
+func (a *AppState) Update(state State, streams StreamCounts, limits Limits) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 	a.state = state
 	a.lastCheckTime = time.Now()
-	a.remoteStreams = remoteStreams
-	a.uploadLimitKbps = uploadLimitKbps
+	a.streams = streams
+	a.limits = limits
 }
 
-func (a *AppState) Get() (State, time.Time, int, int, time.Time) {
+func (a *AppState) Get() (State, time.Time, StreamCounts, Limits, time.Time) {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
-	return a.state, a.lastCheckTime, a.remoteStreams, a.uploadLimitKbps, a.startTime
+	return a.state, a.lastCheckTime, a.streams, a.limits, a.startTime
+}
+
+func (a *AppState) SetHysteresis(status HysteresisStatus) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.hysteresis = status
+}
+
+func (a *AppState) GetHysteresis() HysteresisStatus {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.hysteresis
+}
+
+func (a *AppState) AddDriftCorrections(n int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.driftCorrections += n
+}
+
+func (a *AppState) DriftCorrections() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.driftCorrections
+}
+
+func (a *AppState) SetProfile(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.profile = name
+}
+
+func (a *AppState) Profile() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.profile
+}
+
+func (a *AppState) SetSessions(sessions []SessionVerdict) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sessions = sessions
+}
+
+func (a *AppState) Sessions() []SessionVerdict {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.sessions
 }
 
 type ManualThrottle struct {
@@ -55,6 +107,16 @@ func (m *ManualThrottle) Activate(duration time.Duration, username string) {
 	m.triggeredBy = username
 }
 
+// Restore re-activates a throttle saved by a previous run with its original
+// expiry time.
+func (m *ManualThrottle) Restore(expiresAt time.Time, username string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active = true
+	m.expiresAt = expiresAt
+	m.triggeredBy = username
+}
+
 func (m *ManualThrottle) Deactivate() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -72,6 +134,14 @@ func (m *ManualThrottle) IsActive() bool {
 	return time.Now().Before(m.expiresAt)
 }
 
+// IsSet reports whether a throttle has been activated and not yet
+// deactivated, even if its expiry time has already passed.
+func (m *ManualThrottle) IsSet() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active
+}
+
 func (m *ManualThrottle) TimeRemaining() time.Duration {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TautulliClient reads a Plex server's sessions through Tautulli's API, so
+// only Tautulli needs a Plex token.
+type TautulliClient struct {
+	name    string
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+// tautulliValue holds a field Tautulli may send as a string, number or bool
+// depending on its version.
+type tautulliValue string
+
+func (v *tautulliValue) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*v = ""
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = tautulliValue(s)
+		return nil
+	}
+	*v = tautulliValue(strings.TrimSpace(string(data)))
+	return nil
+}
+
+func (v tautulliValue) Int() int {
+	n, _ := strconv.Atoi(string(v))
+	return n
+}
+
+func (v tautulliValue) Float() float64 {
+	f, _ := strconv.ParseFloat(string(v), 64)
+	return f
+}
+
+func (v tautulliValue) Bool() bool {
+	return v == "1" || v == "true"
+}
+
+type tautulliSession struct {
+	SessionKey         tautulliValue `json:"session_key"`
+	RatingKey          tautulliValue `json:"rating_key"`
+	FullTitle          string        `json:"full_title"`
+	User               string        `json:"user"`
+	Player             string        `json:"player"`
+	Product            string        `json:"product"`
+	MachineID          string        `json:"machine_id"`
+	IPAddress          string        `json:"ip_address"`
+	Location           string        `json:"location"`
+	Local              tautulliValue `json:"local"`
+	State              string        `json:"state"`
+	Bandwidth          tautulliValue `json:"bandwidth"`
+	TranscodeDecision  string        `json:"transcode_decision"`
+	VideoDecision      string        `json:"video_decision"`
+	TranscodeThrottled tautulliValue `json:"transcode_throttled"`
+	TranscodeSpeed     tautulliValue `json:"transcode_speed"`
+	VideoResolution    string        `json:"video_full_resolution"`
+}
+
+func NewTautulliClient(name, baseURL, apiKey string) *TautulliClient {
+	return &TautulliClient{
+		name:    name,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+func (t *TautulliClient) Name() string {
+	return t.name
+}
+
+func (t *TautulliClient) Type() string {
+	return SourceTypeTautulli
+}
+
+// Identity returns the machine identifier of the Plex server behind
+// Tautulli, which is what Plex and Tautulli webhooks carry.
+func (t *TautulliClient) Identity() (string, error) {
+	var info struct {
+		PMSIdentifier string `json:"pms_identifier"`
+	}
+	if err := t.call("get_server_info", &info); err != nil {
+		return "", err
+	}
+	return info.PMSIdentifier, nil
+}
+
+// GetSessions returns the current sessions from get_activity. Bandwidth is
+// Tautulli's per-stream estimate in kbit/s, as with Plex.
+func (t *TautulliClient) GetSessions() ([]Session, error) {
+	var activity struct {
+		Sessions []tautulliSession `json:"sessions"`
+	}
+	if err := t.call("get_activity", &activity); err != nil {
+		return nil, err
+	}
+
+	result := make([]Session, 0, len(activity.Sessions))
+	for _, s := range activity.Sessions {
+		session := Session{
+			Server:        t.name,
+			Key:           string(s.SessionKey),
+			PlayerID:      s.MachineID,
+			RatingKey:     string(s.RatingKey),
+			Title:         s.FullTitle,
+			User:          s.User,
+			Player:        s.Player,
+			Product:       s.Product,
+			Address:       s.IPAddress,
+			Remote:        s.Location == "wan" || !s.Local.Bool(),
+			State:         s.State,
+			BandwidthKbps: (s.Bandwidth.Int() + 7) / 8,
+			Decision:      DecisionDirectPlay,
+			Quality:       s.VideoResolution,
+		}
+		switch s.TranscodeDecision {
+		case "copy":
+			session.Decision = DecisionDirectStream
+		case "transcode":
+			// Only audio may be transcoded, in which case the video is remuxed.
+			session.Decision = DecisionDirectStream
+			if s.VideoDecision == "transcode" {
+				session.Decision = DecisionTranscode
+				session.Throttled = s.TranscodeThrottled.Bool()
+				session.Speed = s.TranscodeSpeed.Float()
+			}
+		}
+		result = append(result, session)
+	}
+	return result, nil
+}
+
+// call runs an API v2 command and decodes its response data into result.
+func (t *TautulliClient) call(cmd string, result interface{}) (err error) {
+	start := time.Now()
+	defer func() { observeRequest(t.name, start, err) }()
+
+	query := url.Values{"apikey": {t.apiKey}, "cmd": {cmd}}
+	req, err := http.NewRequest("GET", t.baseURL+"/api/v2?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("making request: %w", redactURLError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("invalid tautulli api key (401)")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Response struct {
+			Result  string          `json:"result"`
+			Message string          `json:"message"`
+			Data    json.RawMessage `json:"data"`
+		} `json:"response"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	if body.Response.Result != "success" {
+		return fmt.Errorf("%s failed: %s", cmd, body.Response.Message)
+	}
+	if err := json.Unmarshal(body.Response.Data, result); err != nil {
+		return fmt.Errorf("decoding %s data: %w", cmd, err)
+	}
+	return nil
+}
@@ -2,103 +2,286 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	telegramPollTimeoutSec       = 30
+	telegramPollRetryDelay       = 5 * time.Second
+	telegramWebhookCheckInterval = time.Minute
+	telegramWebhookSecretBytes   = 32
+	telegramMaxCaptionLen        = 1024
+)
+
+// TelegramClient sends notifications and receives commands, either by long
+// polling or, with telegram_webhook_url, through a webhook on Server.
 type TelegramClient struct {
-	botToken string
-	chatID   string
-	client   *http.Client
+	botToken        string
+	apiURL          string
+	chats           []TelegramChatConfig
+	users           map[int64]TelegramUserConfig
+	cmdCh           chan<- TelegramCommand
+	defaultDuration time.Duration
+	client          *http.Client
+
+	template *messageTemplate
+
+	webhookURL    string
+	webhookSecret string
+	webhookActive atomic.Bool
 }
 
-func NewTelegramClient(botToken, chatID string) *TelegramClient {
-	if botToken == "" || chatID == "" {
-		return nil
+func NewTelegramClient(cfg *Config, cmdCh chan<- TelegramCommand) (*TelegramClient, error) {
+	if cfg.TelegramBotToken == "" || (len(cfg.TelegramChats) == 0 && len(cfg.TelegramUsers) == 0) {
+		return nil, nil
 	}
 
-	return &TelegramClient{
-		botToken: botToken,
-		chatID:   chatID,
+	byID := make(map[int64]TelegramUserConfig, len(cfg.TelegramUsers))
+	for _, u := range cfg.TelegramUsers {
+		byID[u.ID] = u
+	}
+
+	tmpl, err := newMessageTemplate("telegram_template", cfg.TelegramTemplate, defaultTelegramTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TelegramClient{
+		botToken:        cfg.TelegramBotToken,
+		apiURL:          strings.TrimSuffix(cfg.TelegramAPIURL, "/"),
+		chats:           cfg.TelegramChats,
+		users:           byID,
+		cmdCh:           cmdCh,
+		defaultDuration: time.Duration(cfg.ManualThrottleDefaultMinutes) * time.Minute,
 		client: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		template:   tmpl,
+		webhookURL: cfg.TelegramWebhookURL,
+	}
+
+	if t.webhookURL != "" {
+		// A fresh secret on every start is enough since the webhook is
+		// registered again each time.
+		secret := make([]byte, telegramWebhookSecretBytes)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generating webhook secret: %w", err)
+		}
+		t.webhookSecret = hex.EncodeToString(secret)
 	}
+	return t, nil
 }
 
-func (t *TelegramClient) SendMessage(text string) error {
+// SendMessage sends a notification of the given kind to every chat
+// subscribed to it.
+func (t *TelegramClient) SendMessage(kind, text string) error {
 	if t == nil {
 		return nil
 	}
 
-	payload := map[string]interface{}{
-		"chat_id":    t.chatID,
-		"text":       text,
-		"parse_mode": "Markdown",
+	return t.sendToChats(kind, func(chatID TelegramChatID) error {
+		return t.sendMessage(chatID, text)
+	})
+}
+
+func (t *TelegramClient) sendToChats(kind string, send func(chatID TelegramChatID) error) error {
+	var errs []error
+	for _, chat := range t.chats {
+		if !chat.Subscribed(kind) {
+			continue
+		}
+		if err := send(chat.ID); err != nil {
+			errs = append(errs, fmt.Errorf("chat %s: %w", chat.ID, err))
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return fmt.Errorf("marshaling payload: %w", err)
+func (t *TelegramClient) Name() string {
+	return "telegram"
+}
+
+// Notify implements Notifier, sending to the chats subscribed to the
+// notification's kind. With a poster the message becomes the caption of a
+// photo, unless it is too long for one.
+func (t *TelegramClient) Notify(n Notification) error {
+	n.Title = escapeMarkdown(n.Title)
+	n.Body = escapeMarkdown(n.Body)
+	text := t.template.render(n)
+
+	if n.Poster == nil || len(text) > telegramMaxCaptionLen {
+		return t.SendMessage(n.Kind, text)
 	}
 
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", t.botToken)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	poster, err := n.Poster()
 	if err != nil {
-		return fmt.Errorf("creating request: %w", err)
+		log.Printf("Warning: failed to fetch poster, sending without it: %v", err)
+		return t.SendMessage(n.Kind, text)
 	}
+	return t.sendToChats(n.Kind, func(chatID TelegramChatID) error {
+		return t.sendPhoto(chatID, poster, text)
+	})
+}
 
-	req.Header.Set("Content-Type", "application/json")
+// escapeMarkdown escapes the characters Telegram's legacy Markdown treats as
+// markup, so titles like "The_Office" don't break a message.
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
 
-	resp, err := t.client.Do(req)
-	if err != nil {
-		return fmt.Errorf("making request: %w", err)
+var markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
+
+// Subscribed reports whether the chat wants notifications of the given kind.
+func (c TelegramChatConfig) Subscribed(kind string) bool {
+	return c.Notify == nil || slices.Contains(c.Notify, kind)
+}
+
+// commandRoles is the least privileged role that may run each command.
+var commandRoles = map[string]string{
+	"status":  TelegramRoleViewer,
+	"limit":   TelegramRoleOperator,
+	"unlimit": TelegramRoleOperator,
+	"set":     TelegramRoleAdmin,
+}
+
+var roleRank = map[string]int{
+	TelegramRoleViewer:   1,
+	TelegramRoleOperator: 2,
+	TelegramRoleAdmin:    3,
+}
+
+// Role returns the role of the user who sent cmd, or "" if they aren't
+// authorised. Without telegram_users, everyone in a configured chat is an
+// admin, as before roles existed.
+func (t *TelegramClient) Role(cmd TelegramCommand) string {
+	if len(t.users) > 0 {
+		return t.users[cmd.UserID].Role
 	}
-	defer resp.Body.Close()
+	for _, chat := range t.chats {
+		if chat.ID == numericChatID(cmd.ChatID) {
+			return TelegramRoleAdmin
+		}
+	}
+	return ""
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+// Authorize reports whether the sender of cmd may run it and, if not, a
+// reply explaining why.
+func (t *TelegramClient) Authorize(cmd TelegramCommand) (bool, string) {
+	role := t.Role(cmd)
+	if role == "" {
+		return false, "Sorry, you're not authorised to use this bot."
+	}
+	if need := commandRoles[cmd.Command]; roleRank[role] < roleRank[need] {
+		return false, fmt.Sprintf("Sorry, /%s needs the %s role.", cmd.Command, need)
 	}
+	return true, ""
+}
 
-	return nil
+// displayName names a user in logs and replies, preferring the name given
+// in telegram_users since usernames are optional.
+func (t *TelegramClient) displayName(from TelegramSender) string {
+	if u, ok := t.users[from.ID]; ok && u.Name != "" {
+		return u.Name
+	}
+	if from.Username != "" {
+		return from.Username
+	}
+	if from.FirstName != "" {
+		return from.FirstName
+	}
+	return strconv.FormatInt(from.ID, 10)
 }
 
 type TelegramUpdate struct {
-	UpdateID int              `json:"update_id"`
-	Message  *TelegramMessage `json:"message"`
+	UpdateID      int                    `json:"update_id"`
+	Message       *TelegramMessage       `json:"message"`
+	CallbackQuery *TelegramCallbackQuery `json:"callback_query"`
+}
+
+type TelegramSender struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
 }
 
 type TelegramMessage struct {
-	Chat struct {
+	MessageID int `json:"message_id"`
+	Chat      struct {
 		ID int64 `json:"id"`
 	} `json:"chat"`
-	From struct {
-		Username string `json:"username"`
-	} `json:"from"`
-	Text string `json:"text"`
+	From TelegramSender `json:"from"`
+	Text string         `json:"text"`
 }
 
+// TelegramCallbackQuery is sent when a button of an inline keyboard is
+// pressed. Message is the message the keyboard is attached to.
+type TelegramCallbackQuery struct {
+	ID      string           `json:"id"`
+	From    TelegramSender   `json:"from"`
+	Message *TelegramMessage `json:"message"`
+	Data    string           `json:"data"`
+}
+
+// TelegramCommand is a command typed in the chat or, when CallbackID is
+// set, a button pressed on the status message with ID MessageID. For /set,
+// Setting is the config key to change and Value its new value, or -1 if
+// none was given.
 type TelegramCommand struct {
-	Command  string
-	Duration time.Duration
-	Username string
-	ChatID   int64
+	Command    string
+	Duration   time.Duration
+	Setting    string
+	Value      int
+	UserID     int64
+	Username   string
+	ChatID     int64
+	MessageID  int
+	CallbackID string
+}
+
+type inlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+// statusKeyboard is attached to /status replies. Button data is parsed like
+// the equivalent text command, with ":" in place of the space.
+var statusKeyboard = map[string]interface{}{
+	"inline_keyboard": [][]inlineKeyboardButton{
+		{
+			{Text: "Limit 1h", CallbackData: "limit:1h"},
+			{Text: "Limit 4h", CallbackData: "limit:4h"},
+			{Text: "Limit 24h", CallbackData: "limit:24h"},
+		},
+		{
+			{Text: "Unlimit", CallbackData: "unlimit"},
+			{Text: "Refresh", CallbackData: "status"},
+		},
+	},
 }
 
 func (t *TelegramClient) GetUpdates(offset, timeout int) ([]TelegramUpdate, error) {
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates?timeout=%d&offset=%d",
-		t.botToken, timeout, offset)
+	url := fmt.Sprintf("%s/bot%s/getUpdates?timeout=%d&offset=%d",
+		t.apiURL, t.botToken, timeout, offset)
 
 	client := &http.Client{Timeout: time.Duration(timeout+10) * time.Second}
 	resp, err := client.Get(url)
 	if err != nil {
-		return nil, fmt.Errorf("getting updates: %w", err)
+		return nil, fmt.Errorf("getting updates: %w", redactURLError(err))
 	}
 	defer resp.Body.Close()
 
@@ -118,18 +301,107 @@ func (t *TelegramClient) GetUpdates(offset, timeout int) ([]TelegramUpdate, erro
 }
 
 func (t *TelegramClient) SendReply(chatID int64, text string) error {
-	payload := map[string]interface{}{
+	return t.sendMessage(numericChatID(chatID), text)
+}
+
+// SendStatus sends a status message with the control keyboard attached.
+func (t *TelegramClient) SendStatus(chatID int64, text string) error {
+	return t.send("sendMessage", map[string]interface{}{
+		"chat_id":      chatID,
+		"text":         text,
+		"parse_mode":   "Markdown",
+		"reply_markup": statusKeyboard,
+	})
+}
+
+// EditStatus replaces the text of a status message, keeping its keyboard.
+func (t *TelegramClient) EditStatus(chatID int64, messageID int, text string) error {
+	err := t.send("editMessageText", map[string]interface{}{
+		"chat_id":      chatID,
+		"message_id":   messageID,
+		"text":         text,
+		"parse_mode":   "Markdown",
+		"reply_markup": statusKeyboard,
+	})
+	// Pressing Refresh twice within a second leaves nothing to change.
+	if err != nil && strings.Contains(err.Error(), "message is not modified") {
+		return nil
+	}
+	return err
+}
+
+// AnswerCallback acknowledges a button press, showing text as a short
+// notification if it isn't empty.
+func (t *TelegramClient) AnswerCallback(callbackID, text string) error {
+	if len(text) > 200 {
+		text = text[:200]
+	}
+	return t.send("answerCallbackQuery", map[string]interface{}{
+		"callback_query_id": callbackID,
+		"text":              text,
+	})
+}
+
+func (t *TelegramClient) sendMessage(chatID TelegramChatID, text string) error {
+	return t.send("sendMessage", map[string]interface{}{
 		"chat_id":    chatID,
 		"text":       text,
 		"parse_mode": "Markdown",
+	})
+}
+
+// sendPhoto uploads a photo with a Markdown caption.
+func (t *TelegramClient) sendPhoto(chatID TelegramChatID, photo []byte, caption string) (err error) {
+	defer func() {
+		if err != nil {
+			telegramSendFailures.Inc()
+		}
+	}()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("chat_id", string(chatID))
+	mw.WriteField("caption", caption)
+	mw.WriteField("parse_mode", "Markdown")
+	part, err := mw.CreateFormFile("photo", "poster.jpg")
+	if err != nil {
+		return fmt.Errorf("creating form: %w", err)
+	}
+	part.Write(photo)
+	if err := mw.Close(); err != nil {
+		return fmt.Errorf("creating form: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/bot%s/sendPhoto", t.apiURL, t.botToken)
+	resp, err := t.client.Post(url, mw.FormDataContentType(), &body)
+	if err != nil {
+		return fmt.Errorf("making request: %w", redactURLError(err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Description string `json:"description"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return fmt.Errorf("unexpected status: %d %s", resp.StatusCode, result.Description)
 	}
+	return nil
+}
+
+func (t *TelegramClient) send(method string, payload map[string]interface{}) (err error) {
+	defer func() {
+		if err != nil {
+			telegramSendFailures.Inc()
+		}
+	}()
 
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return fmt.Errorf("marshaling payload: %w", err)
 	}
 
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", t.botToken)
+	url := fmt.Sprintf("%s/bot%s/%s", t.apiURL, t.botToken, method)
 	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("creating request: %w", err)
@@ -139,56 +411,204 @@ func (t *TelegramClient) SendReply(chatID int64, text string) error {
 
 	resp, err := t.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("making request: %w", err)
+		return fmt.Errorf("making request: %w", redactURLError(err))
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+		var result struct {
+			Description string `json:"description"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return fmt.Errorf("unexpected status: %d %s", resp.StatusCode, result.Description)
 	}
 
 	return nil
 }
 
-func (t *TelegramClient) StartPolling(cmdCh chan<- TelegramCommand, defaultDuration time.Duration) {
+// Start begins receiving commands. In webhook mode it registers the webhook
+// and watches that Telegram can deliver to it, falling back to polling if
+// it can't.
+func (t *TelegramClient) Start() {
 	if t == nil {
 		return
 	}
 
+	if t.webhookURL == "" {
+		go t.poll()
+		return
+	}
+
+	if err := t.setWebhook(); err != nil {
+		log.Printf("Warning: failed to set Telegram webhook, falling back to polling: %v", err)
+		go t.poll()
+		return
+	}
+	t.webhookActive.Store(true)
+	log.Printf("Telegram webhook registered at %s", t.webhookURL)
+	go t.watchWebhook()
+}
+
+// Stop removes the webhook, if one is registered, so a later run can poll.
+func (t *TelegramClient) Stop() {
+	if t == nil || !t.webhookActive.Swap(false) {
+		return
+	}
+	if err := t.send("deleteWebhook", map[string]interface{}{}); err != nil {
+		log.Printf("Warning: failed to delete Telegram webhook: %v", err)
+	}
+}
+
+// WebhookActive reports whether updates are currently received through the
+// webhook.
+func (t *TelegramClient) WebhookActive() bool {
+	return t != nil && t.webhookActive.Load()
+}
+
+// ValidWebhookSecret reports whether a webhook request carried the secret
+// the webhook was registered with.
+func (t *TelegramClient) ValidWebhookSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(t.webhookSecret)) == 1
+}
+
+func (t *TelegramClient) setWebhook() error {
+	return t.send("setWebhook", map[string]interface{}{
+		"url":             t.webhookURL,
+		"secret_token":    t.webhookSecret,
+		"allowed_updates": []string{"message", "callback_query"},
+	})
+}
+
+// watchWebhook switches to polling once Telegram reports that deliveries to
+// the webhook are failing and updates are piling up.
+func (t *TelegramClient) watchWebhook() {
+	ticker := time.NewTicker(telegramWebhookCheckInterval)
+	defer ticker.Stop()
+
+	lastCheck := time.Now()
+	for range ticker.C {
+		if !t.webhookActive.Load() {
+			return
+		}
+
+		info, err := t.getWebhookInfo()
+		if err != nil {
+			log.Printf("Warning: failed to get Telegram webhook info: %v", err)
+			continue
+		}
+
+		failing := info.LastErrorDate > lastCheck.Unix() && info.PendingUpdateCount > 0
+		lastCheck = time.Now()
+		if info.URL == t.webhookURL && !failing {
+			continue
+		}
+
+		log.Printf("Warning: Telegram webhook is not being delivered (%s), falling back to polling", info.LastErrorMessage)
+		t.Stop()
+		t.poll()
+		return
+	}
+}
+
+type telegramWebhookInfo struct {
+	URL                string `json:"url"`
+	PendingUpdateCount int    `json:"pending_update_count"`
+	LastErrorDate      int64  `json:"last_error_date"`
+	LastErrorMessage   string `json:"last_error_message"`
+}
+
+func (t *TelegramClient) getWebhookInfo() (*telegramWebhookInfo, error) {
+	resp, err := t.client.Get(fmt.Sprintf("%s/bot%s/getWebhookInfo", t.apiURL, t.botToken))
+	if err != nil {
+		return nil, fmt.Errorf("getting webhook info: %w", redactURLError(err))
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK     bool                `json:"ok"`
+		Result telegramWebhookInfo `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("telegram API returned not OK")
+	}
+	return &result.Result, nil
+}
+
+// poll long-polls for updates. getUpdates is refused while a webhook is
+// set, so any webhook left behind by an earlier run is removed first.
+func (t *TelegramClient) poll() {
+	if err := t.send("deleteWebhook", map[string]interface{}{}); err != nil {
+		log.Printf("Warning: failed to delete Telegram webhook: %v", err)
+	}
+	log.Println("Telegram command polling started")
+
 	offset := 0
 	for {
-		updates, err := t.GetUpdates(offset, 30)
+		updates, err := t.GetUpdates(offset, telegramPollTimeoutSec)
 		if err != nil {
 			log.Printf("Error getting Telegram updates: %v", err)
-			time.Sleep(5 * time.Second)
+			time.Sleep(telegramPollRetryDelay)
 			continue
 		}
 
 		for _, update := range updates {
 			offset = update.UpdateID + 1
+			t.HandleUpdate(update)
+		}
+	}
+}
 
-			if update.Message == nil {
-				continue
-			}
+// HandleUpdate turns an update, polled or received by the webhook, into a
+// command for the main loop.
+func (t *TelegramClient) HandleUpdate(update TelegramUpdate) {
+	if q := update.CallbackQuery; q != nil {
+		t.handleCallback(q)
+		return
+	}
+	if update.Message == nil {
+		return
+	}
 
-			chatIDStr := fmt.Sprintf("%d", update.Message.Chat.ID)
-			if chatIDStr != t.chatID {
-				continue
-			}
+	cmd := parseCommand(update.Message.Text, t.defaultDuration)
+	if cmd == nil {
+		return
+	}
 
-			cmd := parseCommand(update.Message.Text, defaultDuration)
-			if cmd == nil {
-				continue
-			}
+	cmd.ChatID = update.Message.Chat.ID
+	cmd.UserID = update.Message.From.ID
+	cmd.Username = t.displayName(update.Message.From)
 
-			cmd.ChatID = update.Message.Chat.ID
-			cmd.Username = update.Message.From.Username
+	select {
+	case t.cmdCh <- *cmd:
+	default:
+	}
+}
 
-			select {
-			case cmdCh <- *cmd:
-			default:
-			}
-		}
+func (t *TelegramClient) handleCallback(q *TelegramCallbackQuery) {
+	if q.Message == nil {
+		t.AnswerCallback(q.ID, "")
+		return
+	}
+
+	cmd := parseCommand("/"+strings.ReplaceAll(q.Data, ":", " "), t.defaultDuration)
+	if cmd == nil {
+		t.AnswerCallback(q.ID, "Unknown action")
+		return
+	}
+
+	cmd.ChatID = q.Message.Chat.ID
+	cmd.MessageID = q.Message.MessageID
+	cmd.CallbackID = q.ID
+	cmd.UserID = q.From.ID
+	cmd.Username = t.displayName(q.From)
+
+	select {
+	case t.cmdCh <- *cmd:
+	default:
+		t.AnswerCallback(q.ID, "Busy, try again")
 	}
 }
 
@@ -215,6 +635,19 @@ func parseCommand(text string, defaultDuration time.Duration) *TelegramCommand {
 		return &TelegramCommand{Command: "unlimit"}
 	case "status":
 		return &TelegramCommand{Command: "status"}
+	case "set":
+		cmd := &TelegramCommand{Command: "set", Value: -1}
+		if len(parts) > 1 {
+			cmd.Setting = parts[1]
+		}
+		if len(parts) > 2 {
+			if parts[2] == "unlimited" {
+				cmd.Value = 0
+			} else if v, err := strconv.Atoi(parts[2]); err == nil && v >= 0 {
+				cmd.Value = v
+			}
+		}
+		return cmd
 	}
 
 	return nil
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Limits is a pair of global transfer limits in KB/s; 0 means unlimited.
+type Limits struct {
+	UploadKbps   int
+	DownloadKbps int
+}
+
+func (l Limits) String() string {
+	return fmt.Sprintf("upload %s, download %s", formatLimit(l.UploadKbps), formatLimit(l.DownloadKbps))
+}
+
+// Throttler is a download client whose global transfer limits plex-helper
+// controls. Limits are in bytes/second with 0 meaning unlimited.
+type Throttler interface {
+	Name() string
+	Login() error
+	Ping() error
+	SetUploadLimit(bytesPerSec int) error
+	GetUploadLimit() (int, error)
+	SetDownloadLimit(bytesPerSec int) error
+	GetDownloadLimit() (int, error)
+}
+
+// AltSpeedThrottler is implemented by clients with a separate set of
+// alternative ("turtle") limits that can be switched on and off.
+type AltSpeedThrottler interface {
+	Throttler
+	GetSpeedLimitsMode() (bool, error)
+	SetSpeedLimitsMode(enabled bool) error
+}
+
+// errLimitUnsupported is returned by Get*Limit on clients that have no such
+// limit (e.g. uploads on SABnzbd), so reconciliation skips them.
+var errLimitUnsupported = errors.New("limit not supported by this client")
+
+// driftToleranceBytes absorbs unit rounding in clients that don't store
+// limits in bytes (Transmission uses 1000-byte units).
+const driftToleranceBytes = 1024
+
+// ThrottleGroup fans limit changes out to every configured download client
+// so all of them are throttled together.
+type ThrottleGroup struct {
+	strategy   string
+	throttlers []Throttler
+	policies   []*TorrentPolicyManager
+
+	// lastDrift is the drift last corrected on each client, so a client
+	// that keeps reverting is only reported once.
+	lastDrift map[string]string
+}
+
+func NewThrottleGroup(cfg *Config) (*ThrottleGroup, error) {
+	g := &ThrottleGroup{strategy: cfg.ThrottleStrategy, lastDrift: make(map[string]string)}
+
+	for _, dc := range cfg.DownloadClients {
+		var t Throttler
+		switch dc.Type {
+		case ClientTypeQBittorrent:
+			qbt, err := NewQBittorrentClient(dc.Name, dc.URL, dc.Username, dc.Password)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", dc.Name, err)
+			}
+			if p := NewTorrentPolicyManager(qbt, cfg.TorrentPolicies); p != nil {
+				g.policies = append(g.policies, p)
+			}
+			t = qbt
+		case ClientTypeTransmission:
+			tr, err := NewTransmissionClient(dc.Name, dc.URL, dc.Username, dc.Password)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", dc.Name, err)
+			}
+			t = tr
+		case ClientTypeDeluge:
+			d, err := NewDelugeClient(dc.Name, dc.URL, dc.Password)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", dc.Name, err)
+			}
+			t = d
+		case ClientTypeSABnzbd:
+			t = NewSABnzbdClient(dc.Name, dc.URL, dc.APIKey)
+		default:
+			return nil, fmt.Errorf("%s: unknown download client type %q", dc.Name, dc.Type)
+		}
+
+		if cfg.ThrottleStrategy == ThrottleStrategyAltSpeed {
+			if _, ok := t.(AltSpeedThrottler); !ok {
+				return nil, fmt.Errorf("%s: %s does not support throttle_strategy %q", dc.Name, dc.Type, ThrottleStrategyAltSpeed)
+			}
+		}
+		g.throttlers = append(g.throttlers, t)
+	}
+
+	return g, nil
+}
+
+func (g *ThrottleGroup) Throttlers() []Throttler {
+	return g.throttlers
+}
+
+func (g *ThrottleGroup) Login() error {
+	for _, t := range g.throttlers {
+		if err := t.Login(); err != nil {
+			return fmt.Errorf("%s: %w", t.Name(), err)
+		}
+		log.Printf("Connected to %s", t.Name())
+	}
+	return nil
+}
+
+// Apply puts every client into its streaming or idle configuration and
+// returns the limits now in effect. A failing client is logged and doesn't
+// stop the others from being updated; an error is only returned when no
+// client could be updated at all.
+//
+// With the global_limit strategy the given limits are written as the global
+// limits. With alt_speed, each client's alternative speed limits are switched
+// on while streaming and off while idle, and the given limits are ignored in
+// favour of whatever is configured in the client's own UI. The effective
+// limits reported are those of the first client that was updated.
+func (g *ThrottleGroup) Apply(streaming bool, limits Limits) (Limits, error) {
+	var errs []error
+	var effective *Limits
+	for _, t := range g.throttlers {
+		applied, err := g.apply(t, streaming, limits)
+		if err != nil {
+			err = fmt.Errorf("%s: %w", t.Name(), err)
+			log.Printf("Error throttling %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		if effective == nil {
+			effective = &applied
+		}
+	}
+
+	if effective == nil {
+		return Limits{}, errors.Join(errs...)
+	}
+	return *effective, nil
+}
+
+func (g *ThrottleGroup) apply(t Throttler, streaming bool, limits Limits) (Limits, error) {
+	if g.strategy != ThrottleStrategyAltSpeed {
+		if err := t.SetUploadLimit(limits.UploadKbps * 1024); err != nil {
+			return Limits{}, fmt.Errorf("setting upload limit: %w", err)
+		}
+		if err := t.SetDownloadLimit(limits.DownloadKbps * 1024); err != nil {
+			return Limits{}, fmt.Errorf("setting download limit: %w", err)
+		}
+		return limits, nil
+	}
+
+	if err := t.(AltSpeedThrottler).SetSpeedLimitsMode(streaming); err != nil {
+		return Limits{}, err
+	}
+
+	up, err := t.GetUploadLimit()
+	if err != nil {
+		return Limits{}, fmt.Errorf("reading effective upload limit: %w", err)
+	}
+	down, err := t.GetDownloadLimit()
+	if err != nil {
+		return Limits{}, fmt.Errorf("reading effective download limit: %w", err)
+	}
+	return Limits{UploadKbps: up / 1024, DownloadKbps: down / 1024}, nil
+}
+
+// ApplyPolicies applies (streaming) or restores (idle) the per-torrent
+// policies on every qBittorrent client.
+func (g *ThrottleGroup) ApplyPolicies(streaming bool) error {
+	var errs []error
+	for _, p := range g.policies {
+		var err error
+		if streaming {
+			err = p.Apply()
+		} else {
+			err = p.Restore()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.qbt.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PolicyTorrents returns how many torrents the policies currently hold
+// limited or paused across all clients.
+func (g *ThrottleGroup) PolicyTorrents() int {
+	n := 0
+	for _, p := range g.policies {
+		n += p.Tracked()
+	}
+	return n
+}
+
+func (g *ThrottleGroup) PolicySnapshots() map[string]map[string]torrentSnapshot {
+	if len(g.policies) == 0 {
+		return nil
+	}
+
+	snapshots := make(map[string]map[string]torrentSnapshot)
+	for _, p := range g.policies {
+		if snap := p.Snapshot(); len(snap) > 0 {
+			snapshots[p.qbt.Name()] = snap
+		}
+	}
+	return snapshots
+}
+
+func (g *ThrottleGroup) LoadPolicySnapshots(snapshots map[string]map[string]torrentSnapshot) {
+	for _, p := range g.policies {
+		p.Load(snapshots[p.qbt.Name()])
+	}
+}
+
+// Reconcile reads back each client's actual limits and re-applies the
+// desired ones to any client that has drifted, e.g. because someone changed
+// the limit in its UI or it restarted. It returns a description of every
+// correction made, leaving out drift that is the same as the last one
+// corrected on that client since the correction evidently didn't stick.
+func (g *ThrottleGroup) Reconcile(streaming bool, desired Limits) []string {
+	var corrected []string
+	for _, t := range g.throttlers {
+		drift, err := g.drift(t, streaming, desired)
+		if err != nil {
+			log.Printf("Error reading limits from %s: %v", t.Name(), err)
+			continue
+		}
+		if drift == "" {
+			delete(g.lastDrift, t.Name())
+			continue
+		}
+
+		log.Printf("Limit drift on %s: %s, re-applying", t.Name(), drift)
+		if _, err := g.apply(t, streaming, desired); err != nil {
+			log.Printf("Error correcting limit drift on %s: %v", t.Name(), err)
+			continue
+		}
+		if g.lastDrift[t.Name()] == drift {
+			continue
+		}
+		g.lastDrift[t.Name()] = drift
+		corrected = append(corrected, fmt.Sprintf("%s: %s", t.Name(), drift))
+	}
+	return corrected
+}
+
+// drift describes how t differs from the desired configuration, or returns
+// "" if it doesn't.
+func (g *ThrottleGroup) drift(t Throttler, streaming bool, desired Limits) (string, error) {
+	if g.strategy == ThrottleStrategyAltSpeed {
+		enabled, err := t.(AltSpeedThrottler).GetSpeedLimitsMode()
+		if err != nil {
+			return "", err
+		}
+		if enabled != streaming {
+			return fmt.Sprintf("alternative speed limits %s (expected %s)", onOff(enabled), onOff(streaming)), nil
+		}
+		return "", nil
+	}
+
+	var drifts []string
+	checks := []struct {
+		name    string
+		get     func() (int, error)
+		desired int
+	}{
+		{"upload", t.GetUploadLimit, desired.UploadKbps},
+		{"download", t.GetDownloadLimit, desired.DownloadKbps},
+	}
+	for _, c := range checks {
+		actual, err := c.get()
+		if errors.Is(err, errLimitUnsupported) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if actual < 0 {
+			actual = 0
+		}
+		diff := actual - c.desired*1024
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff >= driftToleranceBytes {
+			drifts = append(drifts, fmt.Sprintf("%s %s (expected %s)", c.name, formatLimit(actual/1024), formatLimit(c.desired)))
+		}
+	}
+	return strings.Join(drifts, ", "), nil
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func describeLimit(strategy string, streaming bool, limits Limits) string {
+	if strategy == ThrottleStrategyAltSpeed && streaming {
+		return fmt.Sprintf("%s (alternative speed limits)", limits)
+	}
+	return limits.String()
+}
+
+func describeAction(strategy string, streaming bool, limits Limits) string {
+	if strategy != ThrottleStrategyAltSpeed {
+		return fmt.Sprintf("setting limits to %s", limits)
+	}
+	if streaming {
+		return "enabling alternative speed limits"
+	}
+	return "disabling alternative speed limits"
+}
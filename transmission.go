@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Transmission reports speeds in its own "K" unit, which is 1000 bytes
+// unless the daemon was built with different units.
+const transmissionSpeedBytes = 1000
+
+type TransmissionClient struct {
+	name      string
+	rpcURL    string
+	username  string
+	password  string
+	client    *http.Client
+	mu        sync.Mutex
+	sessionID string
+}
+
+type transmissionRequest struct {
+	Method    string      `json:"method"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type transmissionResponse struct {
+	Result    string          `json:"result"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type transmissionSession struct {
+	Version               string `json:"version"`
+	SpeedLimitUp          int    `json:"speed-limit-up"`
+	SpeedLimitUpEnabled   bool   `json:"speed-limit-up-enabled"`
+	SpeedLimitDown        int    `json:"speed-limit-down"`
+	SpeedLimitDownEnabled bool   `json:"speed-limit-down-enabled"`
+	AltSpeedEnabled       bool   `json:"alt-speed-enabled"`
+	AltSpeedUp            int    `json:"alt-speed-up"`
+	AltSpeedDown          int    `json:"alt-speed-down"`
+}
+
+// NewTransmissionClient accepts either the full RPC URL or the WebUI base
+// URL, in which case /transmission/rpc is appended.
+func NewTransmissionClient(name, baseURL, username, password string) (*TransmissionClient, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/transmission/rpc"
+	}
+
+	return &TransmissionClient{
+		name:     name,
+		rpcURL:   u.String(),
+		username: username,
+		password: password,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+func (t *TransmissionClient) Name() string {
+	return t.name
+}
+
+// Login fetches a session id. Transmission authenticates every request with
+// basic auth, so there is no separate login step.
+func (t *TransmissionClient) Login() error {
+	return t.Ping()
+}
+
+func (t *TransmissionClient) Ping() error {
+	_, err := t.getSession()
+	return err
+}
+
+// SetUploadLimit sets the regular upload limit and turns turtle mode off,
+// since its limits would otherwise be the ones in effect.
+func (t *TransmissionClient) SetUploadLimit(bytesPerSec int) error {
+	return t.call("session-set", map[string]interface{}{
+		"speed-limit-up":         bytesPerSec / transmissionSpeedBytes,
+		"speed-limit-up-enabled": bytesPerSec > 0,
+		"alt-speed-enabled":      false,
+	}, nil)
+}
+
+// GetUploadLimit returns the effective upload limit, which is the turtle
+// mode limit while alt speed is enabled.
+func (t *TransmissionClient) GetUploadLimit() (int, error) {
+	s, err := t.getSession()
+	if err != nil {
+		return 0, err
+	}
+	if s.AltSpeedEnabled {
+		return s.AltSpeedUp * transmissionSpeedBytes, nil
+	}
+	if !s.SpeedLimitUpEnabled {
+		return 0, nil
+	}
+	return s.SpeedLimitUp * transmissionSpeedBytes, nil
+}
+
+func (t *TransmissionClient) SetDownloadLimit(bytesPerSec int) error {
+	return t.call("session-set", map[string]interface{}{
+		"speed-limit-down":         bytesPerSec / transmissionSpeedBytes,
+		"speed-limit-down-enabled": bytesPerSec > 0,
+		"alt-speed-enabled":        false,
+	}, nil)
+}
+
+func (t *TransmissionClient) GetDownloadLimit() (int, error) {
+	s, err := t.getSession()
+	if err != nil {
+		return 0, err
+	}
+	if s.AltSpeedEnabled {
+		return s.AltSpeedDown * transmissionSpeedBytes, nil
+	}
+	if !s.SpeedLimitDownEnabled {
+		return 0, nil
+	}
+	return s.SpeedLimitDown * transmissionSpeedBytes, nil
+}
+
+func (t *TransmissionClient) GetSpeedLimitsMode() (bool, error) {
+	s, err := t.getSession()
+	if err != nil {
+		return false, err
+	}
+	return s.AltSpeedEnabled, nil
+}
+
+// SetSpeedLimitsMode toggles Transmission's "turtle mode", its equivalent
+// of qBittorrent's alternative speed limits.
+func (t *TransmissionClient) SetSpeedLimitsMode(enabled bool) error {
+	if err := t.call("session-set", map[string]interface{}{"alt-speed-enabled": enabled}, nil); err != nil {
+		return err
+	}
+
+	s, err := t.getSession()
+	if err != nil {
+		return fmt.Errorf("verifying alt speed mode: %w", err)
+	}
+	if s.AltSpeedEnabled != enabled {
+		return fmt.Errorf("alt speed mode did not change (enabled=%v)", s.AltSpeedEnabled)
+	}
+	return nil
+}
+
+func (t *TransmissionClient) getSession() (*transmissionSession, error) {
+	var s transmissionSession
+	args := map[string]interface{}{
+		"fields": []string{
+			"version",
+			"speed-limit-up", "speed-limit-up-enabled",
+			"speed-limit-down", "speed-limit-down-enabled",
+			"alt-speed-enabled", "alt-speed-up", "alt-speed-down",
+		},
+	}
+	if err := t.call("session-get", args, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// call performs an RPC request. Transmission answers 409 with a fresh
+// X-Transmission-Session-Id whenever the id is missing or stale; the id is
+// stored and the request retried once.
+func (t *TransmissionClient) call(method string, args interface{}, result interface{}) (err error) {
+	start := time.Now()
+	defer func() { observeRequest(t.name, start, err) }()
+
+	body, err := json.Marshal(transmissionRequest{Method: method, Arguments: args})
+	if err != nil {
+		return fmt.Errorf("marshaling request: %w", err)
+	}
+
+	resp, err := t.post(body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		resp.Body.Close()
+		t.mu.Lock()
+		t.sessionID = resp.Header.Get("X-Transmission-Session-Id")
+		t.mu.Unlock()
+
+		resp, err = t.post(body)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("invalid transmission credentials (401)")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+
+	var rpcResp transmissionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	if rpcResp.Result != "success" {
+		return fmt.Errorf("%s failed: %s", method, rpcResp.Result)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(rpcResp.Arguments, result); err != nil {
+			return fmt.Errorf("decoding arguments: %w", err)
+		}
+	}
+	return nil
+}
+
+func (t *TransmissionClient) post(body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", t.rpcURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if t.username != "" {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	t.mu.Lock()
+	if t.sessionID != "" {
+		req.Header.Set("X-Transmission-Session-Id", t.sessionID)
+	}
+	t.mu.Unlock()
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("making request: %w", err)
+	}
+	return resp, nil
+}
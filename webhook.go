@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// jellyfinWebhookPayload is the body sent by the Jellyfin webhook plugin's
+// generic destination using the template in DEPLOY.md.
+type jellyfinWebhookPayload struct {
+	NotificationType     string `json:"NotificationType"`
+	ServerID             string `json:"ServerId"`
+	NotificationUsername string `json:"NotificationUsername"`
+	DeviceID             string `json:"DeviceId"`
+	DeviceName           string `json:"DeviceName"`
+	RemoteEndPoint       string `json:"RemoteEndPoint"`
+	ItemID               string `json:"ItemId"`
+	Name                 string `json:"Name"`
+	SeriesName           string `json:"SeriesName"`
+	IsPaused             bool   `json:"IsPaused"`
+}
+
+// toEvent maps Jellyfin notifications onto Plex event names. Progress
+// notifications carry the pause state, so they become pause/resume events.
+func (p jellyfinWebhookPayload) toEvent() WebhookEvent {
+	var event string
+	switch p.NotificationType {
+	case "PlaybackStart":
+		event = "media.play"
+	case "PlaybackStop":
+		event = "media.stop"
+	case "PlaybackProgress":
+		event = "media.resume"
+		if p.IsPaused {
+			event = "media.pause"
+		}
+	}
+
+	address := endpointHost(p.RemoteEndPoint)
+	return WebhookEvent{
+		Event:         event,
+		SourceType:    SourceTypeJellyfin,
+		Account:       p.NotificationUsername,
+		ServerUUID:    p.ServerID,
+		PlayerID:      p.DeviceID,
+		PlayerTitle:   p.DeviceName,
+		PlayerAddress: address,
+		Local:         isPrivateAddress(address),
+		RatingKey:     p.ItemID,
+		Title:         displayTitle(p.SeriesName, p.Name),
+	}
+}
+
+// embyWebhookPayload is the body of Emby's built-in webhooks.
+type embyWebhookPayload struct {
+	Event  string `json:"Event"`
+	Server struct {
+		ID string `json:"Id"`
+	} `json:"Server"`
+	User struct {
+		Name string `json:"Name"`
+	} `json:"User"`
+	Item struct {
+		ID         string `json:"Id"`
+		Name       string `json:"Name"`
+		SeriesName string `json:"SeriesName"`
+	} `json:"Item"`
+	Session struct {
+		DeviceID       string `json:"DeviceId"`
+		DeviceName     string `json:"DeviceName"`
+		RemoteEndPoint string `json:"RemoteEndPoint"`
+	} `json:"Session"`
+}
+
+var embyEvents = map[string]string{
+	"playback.start":   "media.play",
+	"playback.pause":   "media.pause",
+	"playback.unpause": "media.resume",
+	"playback.stop":    "media.stop",
+}
+
+func (p embyWebhookPayload) toEvent() WebhookEvent {
+	address := endpointHost(p.Session.RemoteEndPoint)
+	return WebhookEvent{
+		Event:         embyEvents[p.Event],
+		SourceType:    SourceTypeEmby,
+		Account:       p.User.Name,
+		ServerUUID:    p.Server.ID,
+		PlayerID:      p.Session.DeviceID,
+		PlayerTitle:   p.Session.DeviceName,
+		PlayerAddress: address,
+		Local:         isPrivateAddress(address),
+		RatingKey:     p.Item.ID,
+		Title:         displayTitle(p.Item.SeriesName, p.Item.Name),
+	}
+}
+
+// tautulliWebhookPayload is the body sent by Tautulli's webhook notification
+// agent using the JSON data template in DEPLOY.md. Its IDs are the Plex
+// server's, so events are routed like Plex webhooks.
+type tautulliWebhookPayload struct {
+	Action          string        `json:"action"`
+	ServerMachineID string        `json:"server_machine_id"`
+	User            string        `json:"user"`
+	MachineID       string        `json:"machine_id"`
+	Player          string        `json:"player"`
+	IPAddress       string        `json:"ip_address"`
+	StreamLocation  string        `json:"stream_location"`
+	StreamBandwidth tautulliValue `json:"stream_bandwidth"`
+	RatingKey       tautulliValue `json:"rating_key"`
+	Title           string        `json:"title"`
+}
+
+var tautulliEvents = map[string]string{
+	"play":   "media.play",
+	"pause":  "media.pause",
+	"resume": "media.resume",
+	"stop":   "media.stop",
+}
+
+func (p tautulliWebhookPayload) toEvent() WebhookEvent {
+	return WebhookEvent{
+		Event:         tautulliEvents[p.Action],
+		SourceType:    SourceTypePlex,
+		Account:       p.User,
+		ServerUUID:    p.ServerMachineID,
+		PlayerID:      p.MachineID,
+		PlayerTitle:   p.Player,
+		PlayerAddress: p.IPAddress,
+		Local:         p.StreamLocation == "lan",
+		RatingKey:     string(p.RatingKey),
+		Title:         p.Title,
+		BandwidthKbps: (p.StreamBandwidth.Int() + 7) / 8,
+	}
+}
+
+func (s *Server) handleJellyfinWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var webhook jellyfinWebhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	webhooksReceived.Inc(webhook.NotificationType)
+	s.queueEvent(webhook.toEvent())
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleEmbyWebhook accepts both of Emby's request content types: a JSON
+// body, or multipart/form-data with the JSON in a "data" field.
+func (s *Server) handleEmbyWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var webhook embyWebhookPayload
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			http.Error(w, "failed to parse form", http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal([]byte(r.FormValue("data")), &webhook); err != nil {
+			http.Error(w, "invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	webhooksReceived.Inc(webhook.Event)
+	s.queueEvent(webhook.toEvent())
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleTautulliWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var webhook tautulliWebhookPayload
+	if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+		http.Error(w, "invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	webhooksReceived.Inc(webhook.Action)
+	s.queueEvent(webhook.toEvent())
+	w.WriteHeader(http.StatusOK)
+}